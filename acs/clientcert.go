@@ -0,0 +1,78 @@
+package acs
+
+import (
+	"crypto/x509"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/netdoop/cwmp/proto"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// authCertIdentitiesKey is the echo context key of the device identities of
+// the client certificate.
+const authCertIdentitiesKey = "AuthCertIdentities"
+
+// ClientCertAuth returns a middleware that authenticates requests with the
+// TLS client certificate, verified against roots. The TLS server has to
+// request client certificates.
+func ClientCertAuth(roots *x509.CertPool) echo.MiddlewareFunc {
+	logger := zap.L().Named("acs")
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			state := c.Request().TLS
+			if state == nil || len(state.PeerCertificates) == 0 {
+				logger.Debug("client certificate missing")
+				return echo.ErrForbidden
+			}
+			cert := state.PeerCertificates[0]
+			intermediates := x509.NewCertPool()
+			for _, v := range state.PeerCertificates[1:] {
+				intermediates.AddCert(v)
+			}
+			_, err := cert.Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: intermediates,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			})
+			if err != nil {
+				logger.Debug("verify client certificate", zap.Error(err))
+				return echo.ErrForbidden
+			}
+			c.Set(authUsernameKey, cert.Subject.CommonName)
+			c.Set(authCertIdentitiesKey, getCertIdentities(cert))
+			return next(c)
+		}
+	}
+}
+
+// getCertIdentities returns the CN and the DNS and URI SANs of cert.
+func getCertIdentities(cert *x509.Certificate) []string {
+	out := []string{}
+	if cert.Subject.CommonName != "" {
+		out = append(out, cert.Subject.CommonName)
+	}
+	out = append(out, cert.DNSNames...)
+	for _, v := range cert.URIs {
+		out = append(out, v.String())
+	}
+	return out
+}
+
+// checkCertIdentities fails unless one of identities is the device, as
+// "<OUI>-<SerialNumber>" or "<OUI>-<ProductClass>-<SerialNumber>".
+func checkCertIdentities(identities []string, deviceID *proto.DeviceID) error {
+	names := []string{
+		deviceID.OUI + "-" + deviceID.SerialNumber,
+		deviceID.OUI + "-" + deviceID.ProductClass + "-" + deviceID.SerialNumber,
+	}
+	for _, identity := range identities {
+		for _, name := range names {
+			if strings.EqualFold(identity, name) {
+				return nil
+			}
+		}
+	}
+	return errors.Errorf("certificate %v is not device %v", identities, deviceID)
+}
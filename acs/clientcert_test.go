@@ -0,0 +1,154 @@
+package acs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/netdoop/cwmp/proto"
+)
+
+func TestCheckCertIdentities(t *testing.T) {
+	deviceID := &proto.DeviceID{OUI: "001122", ProductClass: "Router", SerialNumber: "SN1"}
+	tests := []struct {
+		name       string
+		identities []string
+		ok         bool
+	}{
+		{"oui serial", []string{"001122-SN1"}, true},
+		{"oui product serial", []string{"001122-Router-SN1"}, true},
+		{"case insensitive", []string{"001122-router-sn1"}, true},
+		{"any identity", []string{"acs.example.com", "001122-SN1"}, true},
+		{"other serial", []string{"001122-SN2"}, false},
+		{"other oui", []string{"334455-SN1"}, false},
+		{"other product", []string{"001122-Switch-SN1"}, false},
+		{"serial only", []string{"SN1"}, false},
+		{"prefix", []string{"001122-SN1-extra"}, false},
+		{"none", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkCertIdentities(tt.identities, deviceID)
+			if (err == nil) != tt.ok {
+				t.Fatalf("error %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestGetCertIdentities(t *testing.T) {
+	uri, _ := url.Parse("urn:dev:ops:001122-Router-SN1")
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "001122-SN1"},
+		DNSNames: []string{"cpe.example.com"},
+		URIs:     []*url.URL{uri},
+	}
+	want := []string{"001122-SN1", "cpe.example.com", "urn:dev:ops:001122-Router-SN1"}
+	if got := getCertIdentities(cert); !reflect.DeepEqual(got, want) {
+		t.Fatalf("identities %v, want %v", got, want)
+	}
+	if got := getCertIdentities(&x509.Certificate{}); len(got) != 0 {
+		t.Fatalf("identities %v, want none", got)
+	}
+}
+
+func newTestCert(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestClientCertAuth(t *testing.T) {
+	now := time.Now()
+	ca, caKey := newTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	client, _ := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "001122-SN1"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	server, _ := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "001122-SN1"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	selfSigned, _ := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(4),
+		Subject:      pkix.Name{CommonName: "001122-SN1"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, nil, nil)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	e := echo.New()
+	e.Use(ClientCertAuth(roots))
+	e.POST("/acs", func(c echo.Context) error {
+		identities, _ := c.Get(authCertIdentitiesKey).([]string)
+		if err := checkCertIdentities(identities, &proto.DeviceID{OUI: "001122", SerialNumber: "SN1"}); err != nil {
+			return err
+		}
+		return c.String(http.StatusOK, c.Get(authUsernameKey).(string))
+	})
+
+	tests := []struct {
+		name   string
+		certs  []*x509.Certificate
+		status int
+	}{
+		{"client certificate", []*x509.Certificate{client}, http.StatusOK},
+		{"no certificate", nil, http.StatusForbidden},
+		{"server certificate", []*x509.Certificate{server}, http.StatusForbidden},
+		{"unknown issuer", []*x509.Certificate{selfSigned}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/acs", nil)
+			req.TLS = &tls.ConnectionState{PeerCertificates: tt.certs}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status %v, want %v", rec.Code, tt.status)
+			}
+			if tt.status == http.StatusOK && rec.Body.String() != "001122-SN1" {
+				t.Fatalf("username %q", rec.Body.String())
+			}
+		})
+	}
+}
@@ -1,33 +1,122 @@
 package acs
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha1"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 )
 
+// ConnectionRequestResult is the outcome of a connection request.
+type ConnectionRequestResult struct {
+	// Sent is true if the CPE accepted the request, or for UDP if it was sent.
+	Sent bool
+	// Skipped is true if no request was made, SkipReason tells why.
+	Skipped    bool
+	SkipReason string
+	// StatusCode is the HTTP status of the last attempt.
+	StatusCode int
+	// AuthScheme is the scheme of the CPE's challenge, Digest or Basic.
+	AuthScheme string
+	Latency    time.Duration
+	Attempts   int
+}
+
+// RetryPolicy tells how often a connection request is attempted.
+type RetryPolicy struct {
+	// Attempts is the number of attempts, 1 if zero.
+	Attempts int
+	// Backoff is the delay before the second attempt, doubled for each
+	// further attempt up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultHttpRetryPolicy makes a single attempt.
+var DefaultHttpRetryPolicy = RetryPolicy{Attempts: 1}
+
+// DefaultUDPRetryPolicy sends the request three times, as Annex G recommends
+// for the unreliable UDP transport.
+var DefaultUDPRetryPolicy = RetryPolicy{Attempts: 3, Backoff: 500 * time.Millisecond, MaxBackoff: 2 * time.Second}
+
+func (p RetryPolicy) getAttempts() int {
+	if p.Attempts < 1 {
+		return 1
+	}
+	return p.Attempts
+}
+
+// getBackoff returns the delay before attempt, counted from 1.
+func (p RetryPolicy) getBackoff(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 2; i < attempt; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d > p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	return d
+}
+
+// wait sleeps before attempt, it fails if ctx is done first.
+func (p RetryPolicy) wait(ctx context.Context, attempt int) error {
+	if attempt < 2 {
+		return nil
+	}
+	timer := time.NewTimer(p.getBackoff(attempt))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
 func SendHttpConnetionRequest(url string, username string, password string) (bool, error) {
-	if url == "" {
-		return false, nil
+	result, err := SendHttpConnectionRequestWithPolicy(context.Background(), url, username, password, DefaultHttpRetryPolicy, nil)
+	if err != nil {
+		return false, err
+	}
+	return result.Sent, nil
+}
+
+// SendHttpConnectionRequestWithPolicy sends an HTTP connection request,
+// attempts are repeated on network errors and 5xx responses. The host must be
+// allowed by network, DefaultNetworkPolicy if nil.
+func SendHttpConnectionRequestWithPolicy(ctx context.Context, url string, username string, password string, policy RetryPolicy, network *NetworkPolicy) (*ConnectionRequestResult, error) {
+	if network == nil {
+		network = DefaultNetworkPolicy
 	}
-	if isLANAddress(url) {
-		return false, nil
+	return sendHttpConnectionRequest(ctx, newConnectionRequestClient(network), network, url, username, password, policy)
+}
+
+// newConnectionRequestClient returns a client that checks network on every
+// dialed address, so DNS changes after the check cannot reach a denied
+// network. Redirects are not followed and no proxy is used, a proxy would
+// hide the dialed address.
+func newConnectionRequestClient(network *NetworkPolicy) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   2 * time.Second, // Connection timeout of 2 seconds
+		KeepAlive: 30 * time.Second,
+		Control:   network.control,
 	}
-	client := &http.Client{
+	return &http.Client{
 		Timeout: time.Second * 10, // Response timeout of 10 seconds
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
 		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   2 * time.Second, // Connection timeout of 2 seconds
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
+			DialContext:           dialer.DialContext,
 			ForceAttemptHTTP2:     true,
 			MaxIdleConns:          100,
 			IdleConnTimeout:       90 * time.Second,
@@ -36,36 +125,162 @@ func SendHttpConnetionRequest(url string, username string, password string) (boo
 			TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
 		},
 	}
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return false, errors.Wrap(err, "create request")
+}
+
+func sendHttpConnectionRequest(ctx context.Context, client *http.Client, network *NetworkPolicy, url string, username string, password string, policy RetryPolicy) (*ConnectionRequestResult, error) {
+	result := &ConnectionRequestResult{}
+	if url == "" {
+		result.Skipped, result.SkipReason = true, "empty url"
+		return result, nil
 	}
-	req.SetBasicAuth(username, password)
-	resp, err := client.Do(req)
+	if err := network.CheckURL(ctx, url); err != nil {
+		result.Skipped, result.SkipReason = true, err.Error()
+		return result, nil
+	}
+
+	start := time.Now()
+	var err error
+	for result.Attempts < policy.getAttempts() {
+		if err2 := policy.wait(ctx, result.Attempts+1); err2 != nil {
+			break
+		}
+		result.Attempts++
+		err = sendHttpConnectionRequestOnce(ctx, client, url, username, password, result)
+		if err == nil || (result.StatusCode > 0 && result.StatusCode < 500) {
+			break
+		}
+	}
+	result.Latency = time.Since(start)
+	return result, err
+}
+
+func sendHttpConnectionRequestOnce(ctx context.Context, client *http.Client, url string, username string, password string, result *ConnectionRequestResult) error {
+	result.StatusCode = 0
+	resp, err := doConnectionRequest(ctx, client, url, "")
 	if err != nil {
-		return false, errors.Wrap(err, "send request")
+		return err
+	}
+	result.StatusCode = resp.StatusCode
+
+	// answer the challenge of the CPE, Digest is preferred over Basic
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenges := resp.Header.Values("WWW-Authenticate")
+		authorization := ""
+		if challenge := getDigestChallenge(challenges); challenge != "" {
+			result.AuthScheme = "Digest"
+			authorization, err = createDigestAuthorization(challenge, http.MethodGet, resp.Request.URL.RequestURI(), username, password)
+			if err != nil {
+				return errors.Wrap(err, "digest auth")
+			}
+		} else if challenge := getAuthChallenge(challenges, "Basic"); challenge != "" {
+			result.AuthScheme = "Basic"
+			req := &http.Request{Header: http.Header{}}
+			req.SetBasicAuth(username, password)
+			authorization = req.Header.Get("Authorization")
+		} else {
+			return errors.Errorf("unsupported challenge %v", challenges)
+		}
+		resp, err = doConnectionRequest(ctx, client, url, authorization)
+		if err != nil {
+			return err
+		}
+		result.StatusCode = resp.StatusCode
 	}
-	defer resp.Body.Close()
 
 	// Check the response status code
 	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNoContent {
-		return true, nil
+		result.Sent = true
+		return nil
+	}
+	return errors.Errorf("connection request failed. Status code: %v", resp.StatusCode)
+}
+
+func doConnectionRequest(ctx context.Context, client *http.Client, url string, authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create request")
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "send request")
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp, nil
+}
+
+// getDigestChallenge returns the parameters of the Digest challenge, SHA-256
+// is preferred over MD5.
+func getDigestChallenge(challenges []string) string {
+	out := ""
+	for _, v := range challenges {
+		name, params, _ := strings.Cut(strings.TrimSpace(v), " ")
+		if !strings.EqualFold(name, "Digest") {
+			continue
+		}
+		if strings.EqualFold(parseDigestParams(params)["algorithm"], "SHA-256") {
+			return params
+		}
+		if out == "" {
+			out = params
+		}
+	}
+	return out
+}
+
+// getAuthChallenge returns the parameters of the challenge of scheme.
+func getAuthChallenge(challenges []string, scheme string) string {
+	for _, v := range challenges {
+		name, params, _ := strings.Cut(strings.TrimSpace(v), " ")
+		if strings.EqualFold(name, scheme) {
+			return params
+		}
 	}
-	return false, errors.Errorf("connection request failed. Status code: %v", resp.StatusCode)
+	return ""
 }
 
+// SendUDPConnectionRequest sends a single UDP connection request, use
+// SendUDPConnectionRequestWithPolicy with DefaultUDPRetryPolicy to resend it.
 func SendUDPConnectionRequest(addr string, username string, password string) (bool, error) {
+	result, err := SendUDPConnectionRequestWithPolicy(context.Background(), addr, username, password, RetryPolicy{Attempts: 1}, nil)
+	if err != nil {
+		return false, err
+	}
+	return result.Sent, nil
+}
+
+// SendUDPConnectionRequestWithPolicy sends a UDP connection request once per
+// attempt, every copy carries the same message ID so the CPE acts on it once.
+// The host must be allowed by network, DefaultNetworkPolicy if nil.
+func SendUDPConnectionRequestWithPolicy(ctx context.Context, addr string, username string, password string, policy RetryPolicy, network *NetworkPolicy) (*ConnectionRequestResult, error) {
+	if network == nil {
+		network = DefaultNetworkPolicy
+	}
+	return sendUDPConnectionRequest(ctx, network, addr, username, password, policy)
+}
+
+func sendUDPConnectionRequest(ctx context.Context, network *NetworkPolicy, addr string, username string, password string, policy RetryPolicy) (*ConnectionRequestResult, error) {
+	result := &ConnectionRequestResult{}
 	if addr == "" {
-		return false, nil
+		result.Skipped, result.SkipReason = true, "empty address"
+		return result, nil
+	}
+	if err := network.CheckAddr(ctx, addr); err != nil {
+		result.Skipped, result.SkipReason = true, err.Error()
+		return result, nil
 	}
 	now := time.Now()
 	timestamp := now.Unix()
 	messageID := fmt.Sprintf("%v", now.UnixNano())
 	cnonce := generateRandomString(16)
 
-	conn, err := net.Dial("udp", addr)
+	dialer := net.Dialer{Control: network.control}
+	conn, err := dialer.DialContext(ctx, "udp", addr)
 	if err != nil {
-		return false, errors.Wrap(err, "create udp connection")
+		return result, errors.Wrap(err, "create udp connection")
 	}
 	defer conn.Close()
 
@@ -79,11 +294,19 @@ func SendUDPConnectionRequest(addr string, username string, password string) (bo
 		addr)
 
 	// Send the UDP Connection Request message
-	_, err = conn.Write([]byte(message))
-	if err != nil {
-		return false, errors.Wrap(err, "send udp connection request")
+	for result.Attempts < policy.getAttempts() {
+		if err := policy.wait(ctx, result.Attempts+1); err != nil {
+			break
+		}
+		result.Attempts++
+		if _, err := conn.Write([]byte(message)); err != nil {
+			result.Latency = time.Since(now)
+			return result, errors.Wrap(err, "send udp connection request")
+		}
+		result.Sent = true
 	}
-	return true, nil
+	result.Latency = time.Since(now)
+	return result, nil
 }
 
 func calculateSignature(timestamp int64, messageID, username, cnonce, password string) string {
@@ -95,28 +318,6 @@ func calculateSignature(timestamp int64, messageID, username, cnonce, password s
 	return signature
 }
 
-func isLANAddress(host string) bool {
-	lanBlocks := []string{
-		"192.168.0.0/16",
-		"172.16.0.0/12",
-		"10.0.0.0/8",
-	}
-
-	ips, err := net.LookupIP(host)
-	if err != nil {
-		return false
-	}
-	for _, ip := range ips {
-		for _, block := range lanBlocks {
-			_, subnet, _ := net.ParseCIDR(block)
-			if subnet.Contains(ip) {
-				return true
-			}
-		}
-	}
-	return false
-}
-
 const charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
 
 func generateRandomString(length int) string {
@@ -0,0 +1,325 @@
+package acs
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	digestRealm       = "cwmp"
+	digestNonceExpiry = 5 * time.Minute
+	// digestPruneInterval is how often expired nonce counts are dropped.
+	digestPruneInterval = time.Minute
+)
+
+// DigestAuthValidator returns the password of username, ok is false if the
+// user is unknown.
+type DigestAuthValidator func(username string, c echo.Context) (password string, ok bool, err error)
+
+// digestAuth implements HTTP Digest authentication (RFC 7616) with qop=auth
+// and MD5. Nonces are signed with a random key, so they need no storage until
+// used, and the nonce count of each used nonce is kept to reject replays.
+type digestAuth struct {
+	logger    *zap.Logger
+	realm     string
+	key       []byte
+	opaque    string
+	validator DigestAuthValidator
+
+	mutex  sync.Mutex
+	counts map[string]*digestNonceCount
+	pruned time.Time
+}
+
+type digestNonceCount struct {
+	nc      uint64
+	expires time.Time
+}
+
+func newDigestAuth(realm string, validator DigestAuthValidator) *digestAuth {
+	key := make([]byte, 32)
+	rand.Read(key)
+	opaque := make([]byte, 16)
+	rand.Read(opaque)
+	return &digestAuth{
+		logger:    zap.L().Named("acs"),
+		realm:     realm,
+		key:       key,
+		opaque:    hex.EncodeToString(opaque),
+		validator: validator,
+		counts:    map[string]*digestNonceCount{},
+		pruned:    time.Now(),
+	}
+}
+
+// DigestAuth returns a middleware that authenticates requests with HTTP Digest.
+func DigestAuth(realm string, validator DigestAuthValidator) echo.MiddlewareFunc {
+	return newDigestAuth(realm, validator).middleware
+}
+
+func (a *digestAuth) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		auth := c.Request().Header.Get(echo.HeaderAuthorization)
+		if auth == "" {
+			return a.challenge(c, false)
+		}
+		stale, err := a.authenticate(c, auth)
+		if err != nil {
+			a.logger.Debug("digest auth", zap.Error(err))
+			return a.challenge(c, stale)
+		}
+		return next(c)
+	}
+}
+
+func (a *digestAuth) challenge(c echo.Context, stale bool) error {
+	value := fmt.Sprintf(`Digest realm="%s", qop="auth", nonce="%s", opaque="%s", algorithm=MD5`,
+		a.realm, a.newNonce(time.Now()), a.opaque)
+	if stale {
+		value += ", stale=true"
+	}
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, value)
+	return echo.ErrUnauthorized
+}
+
+// authenticate checks the Authorization header, stale is true if the
+// credentials are right but the nonce has expired.
+func (a *digestAuth) authenticate(c echo.Context, auth string) (bool, error) {
+	scheme, rest, _ := strings.Cut(auth, " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return false, errors.Errorf("unsupported scheme %v", scheme)
+	}
+	params := parseDigestParams(rest)
+	username := params["username"]
+	nonce := params["nonce"]
+	uri := params["uri"]
+	if username == "" || nonce == "" || uri == "" || params["response"] == "" {
+		return false, errors.New("missing parameters")
+	}
+	if params["realm"] != a.realm {
+		return false, errors.Errorf("invalid realm %v", params["realm"])
+	}
+	if v := params["algorithm"]; v != "" && !strings.EqualFold(v, "MD5") {
+		return false, errors.Errorf("unsupported algorithm %v", v)
+	}
+	if params["qop"] != "auth" {
+		return false, errors.Errorf("unsupported qop %v", params["qop"])
+	}
+	if v := params["opaque"]; v != "" && v != a.opaque {
+		return false, errors.New("invalid opaque")
+	}
+	if u, err := url.ParseRequestURI(uri); err != nil || u.Path != c.Request().URL.Path {
+		return false, errors.Errorf("invalid uri %v", uri)
+	}
+	nc, err := strconv.ParseUint(params["nc"], 16, 64)
+	if err != nil {
+		return false, errors.Wrap(err, "parse nc")
+	}
+	issued, err := a.parseNonce(nonce)
+	if err != nil {
+		return false, err
+	}
+
+	password, ok, err := a.validator(username, c)
+	if err != nil {
+		return false, errors.Wrap(err, "validate user")
+	}
+	if !ok {
+		return false, errors.Errorf("unknown user %v", username)
+	}
+	ha1 := md5Hex(username + ":" + a.realm + ":" + password)
+	ha2 := md5Hex(c.Request().Method + ":" + uri)
+	expected := md5Hex(ha1 + ":" + nonce + ":" + params["nc"] + ":" + params["cnonce"] + ":" + params["qop"] + ":" + ha2)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(params["response"]))) != 1 {
+		return false, errors.Errorf("invalid response of user %v", username)
+	}
+
+	expires := issued.Add(digestNonceExpiry)
+	if time.Now().After(expires) {
+		return true, errors.New("nonce expired")
+	}
+	if err := a.useNonce(nonce, nc, expires); err != nil {
+		return false, err
+	}
+	c.Set(authUsernameKey, username)
+	return false, nil
+}
+
+// useNonce records the nonce count of nonce, which has to increase with
+// every request. Expired counts are dropped every digestPruneInterval.
+func (a *digestAuth) useNonce(nonce string, nc uint64, expires time.Time) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(a.pruned) > digestPruneInterval {
+		for k, v := range a.counts {
+			if now.After(v.expires) {
+				delete(a.counts, k)
+			}
+		}
+		a.pruned = now
+	}
+	if v, ok := a.counts[nonce]; ok {
+		if nc <= v.nc {
+			return errors.Errorf("replayed nonce count %v", nc)
+		}
+		v.nc = nc
+		return nil
+	}
+	a.counts[nonce] = &digestNonceCount{nc: nc, expires: expires}
+	return nil
+}
+
+// newNonce returns "<time>:<random>:<signature>" in base64.
+func (a *digestAuth) newNonce(t time.Time) string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	data := strconv.FormatInt(t.Unix(), 10) + ":" + hex.EncodeToString(buf)
+	return base64.RawURLEncoding.EncodeToString([]byte(data + ":" + a.sign(data)))
+}
+
+// parseNonce checks the signature of nonce and returns the time it was issued.
+func (a *digestAuth) parseNonce(nonce string) (time.Time, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "decode nonce")
+	}
+	i := strings.LastIndex(string(buf), ":")
+	if i < 0 {
+		return time.Time{}, errors.New("invalid nonce")
+	}
+	data, signature := string(buf[:i]), string(buf[i+1:])
+	if !hmac.Equal([]byte(signature), []byte(a.sign(data))) {
+		return time.Time{}, errors.New("invalid nonce signature")
+	}
+	ts, _, _ := strings.Cut(data, ":")
+	seconds, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "parse nonce time")
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+func (a *digestAuth) sign(data string) string {
+	h := hmac.New(sha256.New, a.key)
+	h.Write([]byte(data))
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// createDigestAuthorization answers the Digest challenge of a server, with
+// MD5 or SHA-256 and qop=auth when offered.
+func createDigestAuthorization(challenge string, method string, uri string, username string, password string) (string, error) {
+	params := parseDigestParams(challenge)
+	algorithm := params["algorithm"]
+	hash := md5Hex
+	switch strings.ToUpper(algorithm) {
+	case "", "MD5":
+	case "SHA-256":
+		hash = sha256Hex
+	default:
+		return "", errors.Errorf("unsupported algorithm %v", algorithm)
+	}
+	qop := ""
+	for _, v := range strings.Split(params["qop"], ",") {
+		if strings.TrimSpace(v) == "auth" {
+			qop = "auth"
+		}
+	}
+	if params["qop"] != "" && qop == "" {
+		return "", errors.Errorf("unsupported qop %v", params["qop"])
+	}
+
+	nonce := params["nonce"]
+	ha1 := hash(username + ":" + params["realm"] + ":" + password)
+	ha2 := hash(method + ":" + uri)
+	value := fmt.Sprintf(`Digest username=%s, realm=%s, nonce=%s, uri=%s`,
+		quoteDigestValue(username), quoteDigestValue(params["realm"]), quoteDigestValue(nonce), quoteDigestValue(uri))
+	if qop != "" {
+		buf := make([]byte, 8)
+		rand.Read(buf)
+		cnonce := hex.EncodeToString(buf)
+		nc := "00000001"
+		response := hash(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2)
+		value += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s", response="%s"`, qop, nc, cnonce, response)
+	} else {
+		value += fmt.Sprintf(`, response="%s"`, hash(ha1+":"+nonce+":"+ha2))
+	}
+	if algorithm != "" {
+		value += ", algorithm=" + algorithm
+	}
+	if v, ok := params["opaque"]; ok {
+		value += ", opaque=" + quoteDigestValue(v)
+	}
+	return value, nil
+}
+
+// quoteDigestValue returns s as a quoted string, escaping quotes and
+// backslashes (RFC 7616).
+func quoteDigestValue(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseDigestParams parses the comma separated key=value pairs of a Digest
+// header, values may be quoted.
+func parseDigestParams(s string) map[string]string {
+	params := map[string]string{}
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params
+		}
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return params
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " \t")
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			value = b.String()
+			if i < len(rest) {
+				i++
+			}
+			s = rest[i:]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+	}
+}
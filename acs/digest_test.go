@@ -0,0 +1,164 @@
+package acs
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func newDigestTestServer(a *digestAuth) *echo.Echo {
+	e := echo.New()
+	e.Use(a.middleware)
+	e.POST("/acs", func(c echo.Context) error {
+		return c.String(http.StatusOK, c.Get(authUsernameKey).(string))
+	})
+	return e
+}
+
+func newDigestTestAuth() *digestAuth {
+	return newDigestAuth(digestRealm, func(username string, c echo.Context) (string, bool, error) {
+		if username != "cpe" {
+			return "", false, nil
+		}
+		return "secret", true, nil
+	})
+}
+
+// digestTestAuthorization answers a challenge of a with the nonce count nc.
+func digestTestAuthorization(a *digestAuth, nonce string, username string, password string, nc string) string {
+	ha1 := md5Hex(username + ":" + a.realm + ":" + password)
+	ha2 := md5Hex(http.MethodPost + ":/acs")
+	response := md5Hex(ha1 + ":" + nonce + ":" + nc + ":c0ffee:auth:" + ha2)
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="/acs", qop=auth, nc=%s, cnonce="c0ffee", response="%s", opaque="%s"`,
+		username, a.realm, nonce, nc, response, a.opaque)
+}
+
+func postDigest(e *echo.Echo, authorization string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/acs", nil)
+	if authorization != "" {
+		req.Header.Set(echo.HeaderAuthorization, authorization)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestDigestAuthChallenge(t *testing.T) {
+	a := newDigestTestAuth()
+	rec := postDigest(newDigestTestServer(a), "")
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status %v, want %v", rec.Code, http.StatusUnauthorized)
+	}
+	params := parseDigestParams(strings.TrimPrefix(rec.Header().Get(echo.HeaderWWWAuthenticate), "Digest "))
+	if params["realm"] != digestRealm || params["qop"] != "auth" || params["opaque"] != a.opaque {
+		t.Fatalf("challenge %v", params)
+	}
+	if _, err := a.parseNonce(params["nonce"]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDigestAuth(t *testing.T) {
+	a := newDigestTestAuth()
+	e := newDigestTestServer(a)
+	nonce := a.newNonce(time.Now())
+
+	rec := postDigest(e, digestTestAuthorization(a, nonce, "cpe", "secret", "00000001"))
+	if rec.Code != http.StatusOK || rec.Body.String() != "cpe" {
+		t.Fatalf("status %v body %q", rec.Code, rec.Body.String())
+	}
+	rec = postDigest(e, digestTestAuthorization(a, nonce, "cpe", "secret", "00000002"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("next nonce count: status %v", rec.Code)
+	}
+}
+
+func TestDigestAuthRejects(t *testing.T) {
+	a := newDigestTestAuth()
+	nonce := a.newNonce(time.Now())
+	tampered := base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(time.Now().Unix(), 10) + ":00:" + strings.Repeat("0", 32)))
+	tests := []struct {
+		name          string
+		authorization string
+	}{
+		{"wrong password", digestTestAuthorization(a, nonce, "cpe", "wrong", "00000001")},
+		{"unknown user", digestTestAuthorization(a, nonce, "other", "secret", "00000001")},
+		{"tampered nonce", digestTestAuthorization(a, tampered, "cpe", "secret", "00000001")},
+		{"foreign nonce", digestTestAuthorization(a, newDigestTestAuth().newNonce(time.Now()), "cpe", "secret", "00000001")},
+		{"basic", "Basic Y3BlOnNlY3JldA=="},
+		{"missing qop", strings.Replace(digestTestAuthorization(a, nonce, "cpe", "secret", "00000001"), "qop=auth, ", "", 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := postDigest(newDigestTestServer(a), tt.authorization)
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("status %v, want %v", rec.Code, http.StatusUnauthorized)
+			}
+			if strings.Contains(rec.Header().Get(echo.HeaderWWWAuthenticate), "stale=true") {
+				t.Fatal("unexpected stale challenge")
+			}
+		})
+	}
+}
+
+func TestDigestAuthReplay(t *testing.T) {
+	a := newDigestTestAuth()
+	e := newDigestTestServer(a)
+	nonce := a.newNonce(time.Now())
+	authorization := digestTestAuthorization(a, nonce, "cpe", "secret", "00000002")
+	if rec := postDigest(e, authorization); rec.Code != http.StatusOK {
+		t.Fatalf("status %v", rec.Code)
+	}
+	if rec := postDigest(e, authorization); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("replay: status %v, want %v", rec.Code, http.StatusUnauthorized)
+	}
+	lower := digestTestAuthorization(a, nonce, "cpe", "secret", "00000001")
+	if rec := postDigest(e, lower); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("lower nonce count: status %v, want %v", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestDigestAuthStale(t *testing.T) {
+	a := newDigestTestAuth()
+	e := newDigestTestServer(a)
+	nonce := a.newNonce(time.Now().Add(-digestNonceExpiry - time.Minute))
+
+	rec := postDigest(e, digestTestAuthorization(a, nonce, "cpe", "secret", "00000001"))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status %v, want %v", rec.Code, http.StatusUnauthorized)
+	}
+	if !strings.Contains(rec.Header().Get(echo.HeaderWWWAuthenticate), "stale=true") {
+		t.Fatal("expired nonce without stale=true")
+	}
+
+	// a wrong password is not stale, the CPE must not retry silently
+	rec = postDigest(e, digestTestAuthorization(a, nonce, "cpe", "wrong", "00000001"))
+	if strings.Contains(rec.Header().Get(echo.HeaderWWWAuthenticate), "stale=true") {
+		t.Fatal("stale=true for a wrong password")
+	}
+}
+
+func TestDigestAuthPrunesExpiredNonces(t *testing.T) {
+	a := newDigestTestAuth()
+	a.counts["old"] = &digestNonceCount{nc: 1, expires: time.Now().Add(-time.Second)}
+	if err := a.useNonce("new", 1, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.counts["old"]; !ok {
+		t.Fatal("pruned before digestPruneInterval")
+	}
+	a.pruned = time.Now().Add(-digestPruneInterval - time.Second)
+	if err := a.useNonce("new", 2, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.counts["old"]; ok {
+		t.Fatal("expired nonce count kept")
+	}
+}
@@ -0,0 +1,274 @@
+package acs
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+)
+
+// ConnectionRequest asks a CPE to open a session, over HTTP if URL is set and
+// over UDP otherwise.
+type ConnectionRequest struct {
+	// Key identifies the device, a request is merged into a pending one with
+	// the same key. Requests without a key are never merged.
+	Key     string
+	URL     string
+	UDPAddr string
+	// STUNUsername resolves UDPAddr with the UDPAddressResolver if UDPAddr is empty.
+	STUNUsername string
+	Username     string
+	Password     string
+}
+
+// UDPAddressResolver returns the UDP connection request address of a CPE by
+// its STUNUsername, the stun package Registry is one.
+type UDPAddressResolver interface {
+	GetUDPConnectionRequestAddress(username string) (string, bool)
+}
+
+// DispatchResult is the outcome of a dispatched connection request.
+type DispatchResult struct {
+	Request *ConnectionRequest
+	Result  *ConnectionRequestResult
+	Err     error
+}
+
+type DispatcherOptions struct {
+	// Workers is the number of requests sent at once, 16 if zero.
+	Workers int
+	// QueueSize is the number of requests waiting for a worker, 1024 if zero.
+	QueueSize int
+	// Rate limits the requests per second to one destination host, unlimited if zero.
+	Rate  float64
+	Burst int
+
+	HttpRetryPolicy RetryPolicy
+	UDPRetryPolicy  RetryPolicy
+	// NetworkPolicy decides the reachable hosts, DefaultNetworkPolicy if nil.
+	NetworkPolicy *NetworkPolicy
+	// UDPAddressResolver resolves requests without UDPAddr, optional.
+	UDPAddressResolver UDPAddressResolver
+}
+
+// Dispatcher sends connection requests with a bounded pool of workers and a
+// shared HTTP transport.
+type Dispatcher struct {
+	opts   DispatcherOptions
+	client *http.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	queue  chan *dispatchJob
+	wg     sync.WaitGroup
+
+	mutex    sync.Mutex
+	closed   bool
+	pending  map[string]*dispatchJob
+	limiters map[string]*dispatchLimiter
+}
+
+type dispatchJob struct {
+	req     *ConnectionRequest
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters []*dispatchWaiter
+}
+
+type dispatchWaiter struct {
+	ch   chan *DispatchResult
+	stop func() bool
+}
+
+type dispatchLimiter struct {
+	limiter *rate.Limiter
+	used    time.Time
+}
+
+func NewDispatcher(opts DispatcherOptions) *Dispatcher {
+	if opts.Workers < 1 {
+		opts.Workers = 16
+	}
+	if opts.QueueSize < 1 {
+		opts.QueueSize = 1024
+	}
+	if opts.Burst < 1 {
+		opts.Burst = 1
+	}
+	if opts.HttpRetryPolicy.Attempts < 1 {
+		opts.HttpRetryPolicy = DefaultHttpRetryPolicy
+	}
+	if opts.UDPRetryPolicy.Attempts < 1 {
+		opts.UDPRetryPolicy = DefaultUDPRetryPolicy
+	}
+	if opts.NetworkPolicy == nil {
+		opts.NetworkPolicy = DefaultNetworkPolicy
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{
+		opts:     opts,
+		client:   newConnectionRequestClient(opts.NetworkPolicy),
+		ctx:      ctx,
+		cancel:   cancel,
+		queue:    make(chan *dispatchJob, opts.QueueSize),
+		pending:  map[string]*dispatchJob{},
+		limiters: map[string]*dispatchLimiter{},
+	}
+	for i := 0; i < opts.Workers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+	return d
+}
+
+// Dispatch queues req and returns a channel that receives its result. The
+// request is abandoned once ctx and the contexts of all merged requests are
+// done.
+func (d *Dispatcher) Dispatch(ctx context.Context, req *ConnectionRequest) <-chan *DispatchResult {
+	w := &dispatchWaiter{ch: make(chan *DispatchResult, 1)}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		w.ch <- &DispatchResult{Request: req, Err: errors.New("dispatcher closed")}
+		return w.ch
+	}
+	var job *dispatchJob
+	if req.Key != "" {
+		job = d.pending[req.Key]
+	}
+	if job == nil {
+		job = &dispatchJob{req: req}
+		job.ctx, job.cancel = context.WithCancel(d.ctx)
+		select {
+		case d.queue <- job:
+		default:
+			job.cancel()
+			w.ch <- &DispatchResult{Request: req, Err: errors.New("dispatcher queue full")}
+			return w.ch
+		}
+		if req.Key != "" {
+			d.pending[req.Key] = job
+		}
+	}
+	job.waiters = append(job.waiters, w)
+	w.stop = context.AfterFunc(ctx, func() {
+		d.abandon(job, w, ctx.Err())
+	})
+	return w.ch
+}
+
+// Close stops the workers, pending requests fail.
+func (d *Dispatcher) Close() {
+	d.mutex.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.queue)
+	}
+	d.mutex.Unlock()
+	d.cancel()
+	d.wg.Wait()
+}
+
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+	for job := range d.queue {
+		result, err := d.send(job)
+		d.finish(job, result, err)
+	}
+}
+
+func (d *Dispatcher) send(job *dispatchJob) (*ConnectionRequestResult, error) {
+	req := job.req
+	if err := job.ctx.Err(); err != nil {
+		return nil, err
+	}
+	addr := req.UDPAddr
+	if req.URL == "" && addr == "" && req.STUNUsername != "" && d.opts.UDPAddressResolver != nil {
+		addr, _ = d.opts.UDPAddressResolver.GetUDPConnectionRequestAddress(req.STUNUsername)
+	}
+	if err := d.getLimiter(getDestinationHost(req.URL, addr)).Wait(job.ctx); err != nil {
+		return nil, errors.Wrap(err, "rate limit")
+	}
+	if req.URL != "" {
+		return sendHttpConnectionRequest(job.ctx, d.client, d.opts.NetworkPolicy, req.URL, req.Username, req.Password, d.opts.HttpRetryPolicy)
+	}
+	return sendUDPConnectionRequest(job.ctx, d.opts.NetworkPolicy, addr, req.Username, req.Password, d.opts.UDPRetryPolicy)
+}
+
+func (d *Dispatcher) finish(job *dispatchJob, result *ConnectionRequestResult, err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.pending[job.req.Key] == job {
+		delete(d.pending, job.req.Key)
+	}
+	for _, w := range job.waiters {
+		w.stop()
+		w.ch <- &DispatchResult{Request: job.req, Result: result, Err: err}
+	}
+	job.waiters = nil
+	job.cancel()
+}
+
+// abandon removes waiter w of job, the job is cancelled when no waiter is left.
+func (d *Dispatcher) abandon(job *dispatchJob, w *dispatchWaiter, err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for i, v := range job.waiters {
+		if v == w {
+			job.waiters = append(job.waiters[:i], job.waiters[i+1:]...)
+			w.ch <- &DispatchResult{Request: job.req, Err: err}
+			break
+		}
+	}
+	if len(job.waiters) == 0 {
+		if d.pending[job.req.Key] == job {
+			delete(d.pending, job.req.Key)
+		}
+		job.cancel()
+	}
+}
+
+func (d *Dispatcher) getLimiter(host string) *rate.Limiter {
+	if d.opts.Rate <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	now := time.Now()
+	if v, ok := d.limiters[host]; ok {
+		v.used = now
+		return v.limiter
+	}
+	// forget idle hosts, their limiters are full again anyway
+	if len(d.limiters) >= d.opts.QueueSize {
+		for k, v := range d.limiters {
+			if now.Sub(v.used) > time.Minute {
+				delete(d.limiters, k)
+			}
+		}
+	}
+	v := &dispatchLimiter{
+		limiter: rate.NewLimiter(rate.Limit(d.opts.Rate), d.opts.Burst),
+		used:    now,
+	}
+	d.limiters[host] = v
+	return v.limiter
+}
+
+func getDestinationHost(rawURL string, udpAddr string) string {
+	if rawURL != "" {
+		if u, err := url.Parse(rawURL); err == nil {
+			return u.Hostname()
+		}
+		return rawURL
+	}
+	if host, _, err := net.SplitHostPort(udpAddr); err == nil {
+		return host
+	}
+	return udpAddr
+}
@@ -0,0 +1,298 @@
+package acs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConnReqEndpoint is a CPE connection request URL that holds the requests
+// until it is released.
+type testConnReqEndpoint struct {
+	url      string
+	started  chan string
+	finished chan string
+	release  chan struct{}
+	once     sync.Once
+
+	mutex     sync.Mutex
+	count     int
+	active    int
+	maxActive int
+}
+
+func newTestConnReqEndpoint(t *testing.T) *testConnReqEndpoint {
+	e := &testConnReqEndpoint{
+		started:  make(chan string, 100),
+		finished: make(chan string, 100),
+		release:  make(chan struct{}),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.mutex.Lock()
+		e.count++
+		e.active++
+		if e.active > e.maxActive {
+			e.maxActive = e.active
+		}
+		e.mutex.Unlock()
+		defer func() {
+			e.mutex.Lock()
+			e.active--
+			e.mutex.Unlock()
+		}()
+
+		e.started <- r.URL.Path
+		select {
+		case <-e.release:
+			e.finished <- "released"
+			w.WriteHeader(http.StatusNoContent)
+		case <-r.Context().Done():
+			e.finished <- "cancelled"
+		}
+	}))
+	e.url = srv.URL
+	t.Cleanup(srv.Close)
+	t.Cleanup(e.releaseAll)
+	return e
+}
+
+func (e *testConnReqEndpoint) releaseAll() {
+	e.once.Do(func() { close(e.release) })
+}
+
+func (e *testConnReqEndpoint) getCounts() (int, int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.count, e.maxActive
+}
+
+func (e *testConnReqEndpoint) waitStarted(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-e.started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v of %v requests started", i, n)
+		}
+	}
+}
+
+func (e *testConnReqEndpoint) waitFinished(t *testing.T, want string) {
+	t.Helper()
+	select {
+	case v := <-e.finished:
+		if v != want {
+			t.Fatalf("request %v, want %v", v, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("request not %v", want)
+	}
+}
+
+func newTestDispatcher(t *testing.T, opts DispatcherOptions) *Dispatcher {
+	opts.NetworkPolicy = MustNewNetworkPolicy([]string{"127.0.0.0/8"}, PrivateNetworks)
+	d := NewDispatcher(opts)
+	t.Cleanup(d.Close)
+	return d
+}
+
+func getTestDispatchResult(t *testing.T, ch <-chan *DispatchResult) *DispatchResult {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("no dispatch result")
+		return nil
+	}
+}
+
+func expectTestDispatchSent(t *testing.T, ch <-chan *DispatchResult) {
+	t.Helper()
+	if v := getTestDispatchResult(t, ch); v.Err != nil || v.Result == nil || !v.Result.Sent {
+		t.Fatalf("result %+v error %v", v.Result, v.Err)
+	}
+}
+
+func TestDispatcherWorkers(t *testing.T) {
+	e := newTestConnReqEndpoint(t)
+	d := newTestDispatcher(t, DispatcherOptions{Workers: 2})
+
+	chs := []<-chan *DispatchResult{}
+	for _, key := range []string{"cpe1", "cpe2", "cpe3", "cpe4", "cpe5"} {
+		chs = append(chs, d.Dispatch(context.Background(), &ConnectionRequest{Key: key, URL: e.url + "/" + key}))
+	}
+	e.waitStarted(t, 2)
+	select {
+	case v := <-e.started:
+		t.Fatalf("%v started beyond the workers", v)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	e.releaseAll()
+	for _, ch := range chs {
+		expectTestDispatchSent(t, ch)
+	}
+	if count, maxActive := e.getCounts(); count != 5 || maxActive != 2 {
+		t.Fatalf("count %v max active %v", count, maxActive)
+	}
+}
+
+func TestDispatcherMergesRequests(t *testing.T) {
+	e := newTestConnReqEndpoint(t)
+	d := newTestDispatcher(t, DispatcherOptions{})
+
+	req := &ConnectionRequest{Key: "cpe1", URL: e.url + "/cpe1"}
+	chs := []<-chan *DispatchResult{d.Dispatch(context.Background(), req)}
+	e.waitStarted(t, 1)
+	chs = append(chs, d.Dispatch(context.Background(), req), d.Dispatch(context.Background(), req))
+
+	e.releaseAll()
+	for _, ch := range chs {
+		expectTestDispatchSent(t, ch)
+	}
+	if count, _ := e.getCounts(); count != 1 {
+		t.Fatalf("sent %v times", count)
+	}
+}
+
+func TestDispatcherDoesNotMergeEmptyKey(t *testing.T) {
+	e := newTestConnReqEndpoint(t)
+	d := newTestDispatcher(t, DispatcherOptions{})
+
+	ch1 := d.Dispatch(context.Background(), &ConnectionRequest{URL: e.url + "/cpe1"})
+	ch2 := d.Dispatch(context.Background(), &ConnectionRequest{URL: e.url + "/cpe2"})
+	e.waitStarted(t, 2)
+
+	e.releaseAll()
+	expectTestDispatchSent(t, ch1)
+	expectTestDispatchSent(t, ch2)
+	if count, _ := e.getCounts(); count != 2 {
+		t.Fatalf("sent %v times", count)
+	}
+}
+
+func TestDispatcherAbandon(t *testing.T) {
+	e := newTestConnReqEndpoint(t)
+	d := newTestDispatcher(t, DispatcherOptions{})
+	req := &ConnectionRequest{Key: "cpe1", URL: e.url + "/cpe1"}
+
+	// an abandoning waiter gets its error, the request goes on for the others
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ch1 := d.Dispatch(ctx1, req)
+	ch2 := d.Dispatch(context.Background(), req)
+	e.waitStarted(t, 1)
+	cancel1()
+	if v := getTestDispatchResult(t, ch1); v.Err != context.Canceled {
+		t.Fatalf("abandoned waiter error %v", v.Err)
+	}
+	e.releaseAll()
+	e.waitFinished(t, "released")
+	expectTestDispatchSent(t, ch2)
+
+	// the request is cancelled when its last waiter abandons it
+	e2 := newTestConnReqEndpoint(t)
+	ctx3, cancel3 := context.WithCancel(context.Background())
+	ch3 := d.Dispatch(ctx3, &ConnectionRequest{Key: "cpe2", URL: e2.url + "/cpe2"})
+	e2.waitStarted(t, 1)
+	cancel3()
+	if v := getTestDispatchResult(t, ch3); v.Err != context.Canceled {
+		t.Fatalf("abandoned waiter error %v", v.Err)
+	}
+	e2.waitFinished(t, "cancelled")
+
+	// a done context abandons at once
+	ctx4, cancel4 := context.WithCancel(context.Background())
+	cancel4()
+	if v := getTestDispatchResult(t, d.Dispatch(ctx4, &ConnectionRequest{Key: "cpe3", URL: e2.url + "/cpe3"})); v.Err != context.Canceled {
+		t.Fatalf("done context error %v", v.Err)
+	}
+}
+
+func TestDispatcherQueueFull(t *testing.T) {
+	e := newTestConnReqEndpoint(t)
+	d := newTestDispatcher(t, DispatcherOptions{Workers: 1, QueueSize: 1})
+
+	ch1 := d.Dispatch(context.Background(), &ConnectionRequest{Key: "cpe1", URL: e.url + "/cpe1"})
+	e.waitStarted(t, 1)
+	ch2 := d.Dispatch(context.Background(), &ConnectionRequest{Key: "cpe2", URL: e.url + "/cpe2"})
+	v := getTestDispatchResult(t, d.Dispatch(context.Background(), &ConnectionRequest{Key: "cpe3", URL: e.url + "/cpe3"}))
+	if v.Err == nil || !strings.Contains(v.Err.Error(), "queue full") {
+		t.Fatalf("full queue error %v", v.Err)
+	}
+
+	// the refused request is not pending, it can be dispatched again
+	e.releaseAll()
+	expectTestDispatchSent(t, ch1)
+	expectTestDispatchSent(t, ch2)
+	expectTestDispatchSent(t, d.Dispatch(context.Background(), &ConnectionRequest{Key: "cpe3", URL: e.url + "/cpe3"}))
+}
+
+func TestDispatcherClose(t *testing.T) {
+	e := newTestConnReqEndpoint(t)
+	d := newTestDispatcher(t, DispatcherOptions{Workers: 1})
+
+	ch1 := d.Dispatch(context.Background(), &ConnectionRequest{Key: "cpe1", URL: e.url + "/cpe1"})
+	e.waitStarted(t, 1)
+	ch2 := d.Dispatch(context.Background(), &ConnectionRequest{Key: "cpe2", URL: e.url + "/cpe2"})
+
+	closed := make(chan struct{})
+	go func() {
+		d.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close blocked on pending requests")
+	}
+	for _, ch := range []<-chan *DispatchResult{ch1, ch2} {
+		if v := getTestDispatchResult(t, ch); v.Err == nil {
+			t.Fatalf("pending request result %+v after close", v.Result)
+		}
+	}
+	e.waitFinished(t, "cancelled")
+	if count, _ := e.getCounts(); count != 1 {
+		t.Fatalf("sent %v times", count)
+	}
+
+	v := getTestDispatchResult(t, d.Dispatch(context.Background(), &ConnectionRequest{Key: "cpe3", URL: e.url + "/cpe3"}))
+	if v.Err == nil || !strings.Contains(v.Err.Error(), "closed") {
+		t.Fatalf("closed dispatcher error %v", v.Err)
+	}
+}
+
+func TestDispatcherLimiterEviction(t *testing.T) {
+	d := newTestDispatcher(t, DispatcherOptions{QueueSize: 2, Rate: 1})
+
+	l1 := d.getLimiter("host1")
+	d.getLimiter("host2")
+	if d.getLimiter("host1") != l1 {
+		t.Fatal("limiter not kept")
+	}
+
+	// a new host evicts the idle hosts once QueueSize hosts are known
+	d.mutex.Lock()
+	d.limiters["host1"].used = time.Now().Add(-2 * time.Minute)
+	d.mutex.Unlock()
+	d.getLimiter("host3")
+	d.mutex.Lock()
+	_, ok1 := d.limiters["host1"]
+	_, ok2 := d.limiters["host2"]
+	n := len(d.limiters)
+	d.mutex.Unlock()
+	if ok1 || !ok2 || n != 2 {
+		t.Fatalf("host1 kept %v host2 kept %v limiters %v", ok1, ok2, n)
+	}
+
+	// without a rate nothing is kept
+	d2 := newTestDispatcher(t, DispatcherOptions{})
+	d2.getLimiter("host1")
+	if len(d2.limiters) != 0 {
+		t.Fatalf("limiters %v without a rate", len(d2.limiters))
+	}
+}
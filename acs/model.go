@@ -84,6 +84,9 @@ type Product interface {
 	GetDataModel() DataModel
 }
 
+// MethodCall is an RPC queued for a device. For vendor methods named
+// X_<OUI>_<Method> the request value "RawXML" is sent as the content of the
+// method element, otherwise every request value becomes a child element.
 type MethodCall interface {
 	GetMethodName() string
 	GetCommandKey() string
@@ -101,6 +104,15 @@ type Device interface {
 	UpdateMethodCallUnknow(commandKey string) error
 }
 
+// CredentialsProvider resolves the credentials of each CPE for Basic and
+// Digest authentication.
+type CredentialsProvider interface {
+	// GetCredentials returns the password of username, ok is false for unknown users.
+	GetCredentials(ctx context.Context, username string) (password string, ok bool, err error)
+	// CheckDevice fails if username may not open sessions for the device of the Inform.
+	CheckDevice(ctx context.Context, username string, deviceID *proto.DeviceID) error
+}
+
 type AcsHanlder interface {
 	GetProduct(schema string, oui string, productClass string) Product
 	GetDevice(schema string, oui string, productClass string, serialNumber string) Device
@@ -110,6 +122,11 @@ type AcsHanlder interface {
 
 	HandleTransferComplete(ctx context.Context, device Device, req *proto.TransferComplete) error
 	HandleAutonomousTransferComplete(ctx context.Context, device Device, req *proto.AutonomousTransferComplete) error
+	HandleDUStateChangeComplete(ctx context.Context, device Device, req *proto.DUStateChangeComplete) error
+	HandleAutonomousDUStateChangeComplete(ctx context.Context, device Device, req *proto.AutonomousDUStateChangeComplete) error
+	HandleRequestDownload(ctx context.Context, device Device, req *proto.RequestDownload) error
+	// HandleKicked returns the NextURL the CPE's browser is redirected to.
+	HandleKicked(ctx context.Context, device Device, req *proto.Kicked) (string, error)
 	HandleGetRPCMethodsResponse(ctx context.Context, device Device, id string, resp *proto.GetRPCMethodsResponse) error
 	HandleGetParameterValuesResponse(ctx context.Context, device Device, id string, resp *proto.GetParameterValuesResponse) error
 	HandleSetParameterValuesResponse(ctx context.Context, device Device, id string, resp *proto.SetParameterValuesResponse) error
@@ -122,6 +139,19 @@ type AcsHanlder interface {
 	HandleUploadResponse(ctx context.Context, device Device, id string, resp *proto.UploadResponse) error
 	HandleRebootResponse(ctx context.Context, device Device, id string, resp *proto.RebootResponse) error
 	HandleFactoryResetResponse(ctx context.Context, device Device, id string, resp *proto.FactoryResetResponse) error
+	HandleScheduleInformResponse(ctx context.Context, device Device, id string, resp *proto.ScheduleInformResponse) error
+	HandleScheduleDownloadResponse(ctx context.Context, device Device, id string, resp *proto.ScheduleDownloadResponse) error
+	HandleChangeDUStateResponse(ctx context.Context, device Device, id string, resp *proto.ChangeDUStateResponse) error
+	HandleGetQueuedTransfersResponse(ctx context.Context, device Device, id string, resp *proto.GetQueuedTransfersResponse) error
+	HandleGetAllQueuedTransfersResponse(ctx context.Context, device Device, id string, resp *proto.GetAllQueuedTransfersResponse) error
+	HandleCancelTransferResponse(ctx context.Context, device Device, id string, resp *proto.CancelTransferResponse) error
+	HandleSetVouchersResponse(ctx context.Context, device Device, id string, resp *proto.SetVouchersResponse) error
+	HandleGetOptionsResponse(ctx context.Context, device Device, id string, resp *proto.GetOptionsResponse) error
+	// HandleRawResponse receives the unparsed response to a vendor specific method.
+	HandleRawResponse(ctx context.Context, device Device, id string, resp *proto.RawBody) error
+
+	// HandleSessionTransition observes each change of a session's state.
+	HandleSessionTransition(ctx context.Context, session *Session, event SessionEvent, from SessionState, to SessionState)
 
 	HandleMesureValues(device Device, filename string, values map[string]any)
 }
@@ -0,0 +1,198 @@
+package acs
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PrivateNetworks lists the loopback, link-local, private and CGNAT networks
+// of IPv4 and IPv6.
+var PrivateNetworks = []string{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"169.254.0.0/16",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// DefaultNetworkPolicy is consulted by the connection request senders, it
+// denies PrivateNetworks.
+var DefaultNetworkPolicy = MustNewNetworkPolicy(nil, PrivateNetworks)
+
+// NetworkPolicy decides which hosts connection requests may be sent to. An
+// address in Allow is allowed, else an address in Deny is denied, else it is
+// allowed. A host name is allowed if all its addresses are, a name that
+// cannot be resolved is denied and its connection request is skipped. The
+// senders check the URL before sending and again every dialed address.
+type NetworkPolicy struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+	// LookupTimeout bounds DNS lookups, 2s if zero.
+	LookupTimeout time.Duration
+	// CacheTTL is how long lookups are kept, 5m if zero.
+	CacheTTL time.Duration
+	// Resolver looks up host names, net.DefaultResolver if nil.
+	Resolver *net.Resolver
+
+	mutex sync.Mutex
+	cache map[string]*networkPolicyLookup
+}
+
+type networkPolicyLookup struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// NewNetworkPolicy returns a policy with the allowed and denied CIDRs.
+func NewNetworkPolicy(allow []string, deny []string) (*NetworkPolicy, error) {
+	p := &NetworkPolicy{}
+	for _, v := range allow {
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse allowed network %v", v)
+		}
+		p.Allow = append(p.Allow, ipNet)
+	}
+	for _, v := range deny {
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse denied network %v", v)
+		}
+		p.Deny = append(p.Deny, ipNet)
+	}
+	return p, nil
+}
+
+func MustNewNetworkPolicy(allow []string, deny []string) *NetworkPolicy {
+	p, err := NewNetworkPolicy(allow, deny)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// CheckURL fails if the host of rawURL is denied.
+func (p *NetworkPolicy) CheckURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return errors.Wrap(err, "parse url")
+	}
+	return p.CheckHost(ctx, u.Hostname())
+}
+
+// CheckAddr fails if the host of the "host:port" addr is denied.
+func (p *NetworkPolicy) CheckAddr(ctx context.Context, addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.Wrap(err, "parse address")
+	}
+	return p.CheckHost(ctx, host)
+}
+
+// CheckHost fails if host, an IP address or a name, is denied.
+func (p *NetworkPolicy) CheckHost(ctx context.Context, host string) error {
+	if host == "" {
+		return errors.New("empty host")
+	}
+	ips, err := p.lookup(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if err := p.CheckIP(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckIP fails if ip is denied.
+func (p *NetworkPolicy) CheckIP(ip net.IP) error {
+	if v := ip.To4(); v != nil {
+		ip = v
+	}
+	for _, ipNet := range p.Allow {
+		if ipNet.Contains(ip) {
+			return nil
+		}
+	}
+	for _, ipNet := range p.Deny {
+		if ipNet.Contains(ip) {
+			return errors.Errorf("%v is in denied network %v", ip, ipNet)
+		}
+	}
+	return nil
+}
+
+// control is a net.Dialer Control that fails if the dialed address is denied.
+func (p *NetworkPolicy) control(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return errors.Wrap(err, "parse address")
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errors.Errorf("invalid address %v", address)
+	}
+	return p.CheckIP(ip)
+}
+
+func (p *NetworkPolicy) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	now := time.Now()
+	p.mutex.Lock()
+	if v, ok := p.cache[host]; ok && now.Before(v.expires) {
+		p.mutex.Unlock()
+		return v.ips, nil
+	}
+	p.mutex.Unlock()
+
+	timeout := p.LookupTimeout
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	resolver := p.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "lookup %v", host)
+	}
+	ips := []net.IP{}
+	for _, v := range addrs {
+		ips = append(ips, v.IP)
+	}
+
+	ttl := p.CacheTTL
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.cache == nil {
+		p.cache = map[string]*networkPolicyLookup{}
+	}
+	for k, v := range p.cache {
+		if now.After(v.expires) {
+			delete(p.cache, k)
+		}
+	}
+	p.cache[host] = &networkPolicyLookup{ips: ips, expires: now.Add(ttl)}
+	return ips, nil
+}
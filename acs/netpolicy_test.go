@@ -0,0 +1,242 @@
+package acs
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNetworkPolicyCheckIP(t *testing.T) {
+	p := MustNewNetworkPolicy([]string{"10.1.0.0/16", "fd00::/64"}, []string{"10.0.0.0/8", "fc00::/7", "127.0.0.0/8"})
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		// Allow is consulted before Deny
+		{"10.1.2.3", true},
+		{"10.2.2.3", false},
+		{"fd00::1", true},
+		{"fd01::1", false},
+		// anything else is allowed
+		{"192.0.2.1", true},
+		{"2001:db8::1", true},
+		// IPv4-mapped IPv6 addresses are checked as IPv4
+		{"::ffff:10.1.2.3", true},
+		{"::ffff:10.2.2.3", false},
+		{"::ffff:127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if err := p.CheckIP(net.ParseIP(tt.ip)); (err == nil) != tt.allowed {
+			t.Errorf("CheckIP(%v) = %v, want allowed %v", tt.ip, err, tt.allowed)
+		}
+	}
+}
+
+func TestNetworkPolicyCheckURL(t *testing.T) {
+	p := DefaultNetworkPolicy
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"http://192.0.2.1:7547/", true},
+		{"http://127.0.0.1:7547/", false},
+		{"http://[::1]:7547/", false},
+		{"http://[::ffff:192.168.1.1]:7547/", false},
+		{"http://[2001:db8::1]/", true},
+		{"http:///path", false},
+	}
+	for _, tt := range tests {
+		if err := p.CheckURL(context.Background(), tt.url); (err == nil) != tt.allowed {
+			t.Errorf("CheckURL(%v) = %v, want allowed %v", tt.url, err, tt.allowed)
+		}
+	}
+	if err := p.CheckAddr(context.Background(), "10.0.0.1:7547"); err == nil {
+		t.Error("CheckAddr allowed a private address")
+	}
+	if err := p.CheckAddr(context.Background(), "192.0.2.1"); err == nil {
+		t.Error("CheckAddr allowed an address without a port")
+	}
+}
+
+// newTestDNSResolver returns a resolver served by a local DNS server that
+// answers every A query with ip and counts the queries.
+func newTestDNSResolver(t *testing.T, ip net.IP) (*net.Resolver, func() int) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var mutex sync.Mutex
+	queries := 0
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 12 {
+				continue
+			}
+			mutex.Lock()
+			queries++
+			mutex.Unlock()
+
+			// copy the ID and the question, answer A queries only
+			q := buf[12:n]
+			end := 0
+			for end < len(q) && q[end] != 0 {
+				end += int(q[end]) + 1
+			}
+			if end+5 > len(q) {
+				continue
+			}
+			question := q[:end+5]
+			res := make([]byte, 12, 64)
+			copy(res[0:2], buf[0:2])
+			binary.BigEndian.PutUint16(res[2:4], 0x8180)
+			binary.BigEndian.PutUint16(res[4:6], 1)
+			res = append(res, question...)
+			if binary.BigEndian.Uint16(question[end+1:]) == 1 {
+				binary.BigEndian.PutUint16(res[6:8], 1)
+				res = append(res, 0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+				res = append(res, ip.To4()...)
+			}
+			conn.WriteTo(res, addr)
+		}
+	}()
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp4", conn.LocalAddr().String())
+		},
+	}
+	return resolver, func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return queries
+	}
+}
+
+func TestNetworkPolicyLookupCache(t *testing.T) {
+	resolver, getQueries := newTestDNSResolver(t, net.ParseIP("10.0.0.1"))
+	p := MustNewNetworkPolicy(nil, PrivateNetworks)
+	p.Resolver = resolver
+	p.CacheTTL = time.Hour
+
+	// a name is denied by the addresses it resolves to
+	err := p.CheckHost(context.Background(), "cpe.test")
+	if err == nil || !strings.Contains(err.Error(), "denied network") {
+		t.Fatalf("resolved to a denied address: %v", err)
+	}
+	queries := getQueries()
+	if queries == 0 {
+		t.Fatal("not resolved")
+	}
+
+	// the lookup is cached
+	if err := p.CheckHost(context.Background(), "cpe.test"); err == nil {
+		t.Fatal("cached lookup allowed")
+	}
+	if v := getQueries(); v != queries {
+		t.Fatalf("%v queries after a cached lookup, want %v", v, queries)
+	}
+
+	// an expired lookup is resolved again, the other names are kept
+	p.mutex.Lock()
+	p.cache["cpe.test"].expires = time.Now().Add(-time.Second)
+	p.cache["other.test"] = &networkPolicyLookup{ips: []net.IP{net.ParseIP("192.0.2.1")}, expires: time.Now().Add(time.Hour)}
+	p.mutex.Unlock()
+	if err := p.CheckHost(context.Background(), "cpe.test"); err == nil {
+		t.Fatal("expired lookup allowed")
+	}
+	if v := getQueries(); v == queries {
+		t.Fatal("expired lookup not resolved again")
+	}
+	if err := p.CheckHost(context.Background(), "other.test"); err != nil {
+		t.Fatalf("cached name: %v", err)
+	}
+}
+
+func TestNetworkPolicyLookupFailure(t *testing.T) {
+	p := MustNewNetworkPolicy(nil, nil)
+	p.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError("test")}
+		},
+	}
+	p.LookupTimeout = time.Second
+
+	// a name that cannot be resolved is denied and not cached
+	if err := p.CheckHost(context.Background(), "cpe.test"); err == nil {
+		t.Fatal("unresolved name allowed")
+	}
+	if len(p.cache) != 0 {
+		t.Fatalf("failed lookup cached: %v", p.cache)
+	}
+	if err := p.CheckHost(context.Background(), ""); err == nil {
+		t.Fatal("empty host allowed")
+	}
+}
+
+func TestNetworkPolicyControl(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	// the dialer checks the dialed address, whatever the URL was checked as
+	client := newConnectionRequestClient(DefaultNetworkPolicy)
+	_, err := client.Get(srv.URL)
+	if err == nil || !strings.Contains(err.Error(), "denied network") {
+		t.Fatalf("dialed a denied address: %v", err)
+	}
+	client = newConnectionRequestClient(MustNewNetworkPolicy([]string{"127.0.0.0/8"}, PrivateNetworks))
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("allowed address: %v", err)
+	}
+	resp.Body.Close()
+
+	dialer := net.Dialer{Control: DefaultNetworkPolicy.control}
+	if _, err := dialer.Dial("udp", "127.0.0.1:7547"); err == nil {
+		t.Fatal("udp dialed a denied address")
+	}
+}
+
+func TestSendConnectionRequestNetworkPolicy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	loopback := MustNewNetworkPolicy([]string{"127.0.0.0/8"}, PrivateNetworks)
+
+	// nil is DefaultNetworkPolicy, which skips loopback
+	result, err := SendHttpConnectionRequestWithPolicy(context.Background(), srv.URL, "", "", DefaultHttpRetryPolicy, nil)
+	if err != nil || !result.Skipped {
+		t.Fatalf("default policy: result %+v error %v", result, err)
+	}
+	result, err = SendHttpConnectionRequestWithPolicy(context.Background(), srv.URL, "", "", DefaultHttpRetryPolicy, loopback)
+	if err != nil || !result.Sent {
+		t.Fatalf("loopback policy: result %+v error %v", result, err)
+	}
+
+	addr := conn.LocalAddr().String()
+	result, err = SendUDPConnectionRequestWithPolicy(context.Background(), addr, "", "", RetryPolicy{Attempts: 1}, nil)
+	if err != nil || !result.Skipped {
+		t.Fatalf("default policy: result %+v error %v", result, err)
+	}
+	result, err = SendUDPConnectionRequestWithPolicy(context.Background(), addr, "", "", RetryPolicy{Attempts: 1}, loopback)
+	if err != nil || !result.Sent {
+		t.Fatalf("loopback policy: result %+v error %v", result, err)
+	}
+}
@@ -1,9 +1,14 @@
 package acs
 
 import (
+	"context"
 	"encoding/xml"
 	"io"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/sessions"
 	"github.com/labstack/echo-contrib/session"
@@ -14,197 +19,505 @@ import (
 	"go.uber.org/zap"
 )
 
+// acsRPCMethods lists the methods the ACS accepts from the CPE.
+var acsRPCMethods = []string{
+	"Inform",
+	"GetRPCMethods",
+	"TransferComplete",
+	"AutonomousTransferComplete",
+	"DUStateChangeComplete",
+	"AutonomousDUStateChangeComplete",
+	"RequestDownload",
+	"Kicked",
+}
+
 func (s *AcsServer) HandlePost(c echo.Context) error {
 	r := c.Request()
-	contentType := r.Header.Get("Content-Type")
 	ctx := r.Context()
 	sess, _ := session.Get("session", c)
+	// options are not stored, later saves have to reuse the cookie of the Inform
+	if !sess.IsNew {
+		sess.Options = newSessionOptions()
+	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, errors.Wrap(err, "read body").Error())
 	}
 
-	var msg *proto.SoapEnvelope = nil
+	// a POST may carry several envelopes, up to the MaxEnvelopes of the InformResponse
+	msgs := []*proto.SoapEnvelope{}
+	bodyElements := []string{}
 	if len(body) > 0 {
 		body = proto.CleanXMLData(body)
-		msg = &proto.SoapEnvelope{}
-		if err := xml.Unmarshal(body, msg); err != nil {
+		chunks, err := proto.SplitEnvelopes(body)
+		if err != nil {
 			s.logger.Error("handle post", zap.Error(err))
 			s.logger.Debug("debug", zap.String("body", string(body)))
-			return echo.NewHTTPError(http.StatusBadRequest, errors.Wrap(err, "unmarshal xml").Error())
+			return echo.NewHTTPError(http.StatusBadRequest, errors.Wrap(err, "split envelopes").Error())
 		}
-		msg.Decode()
-	}
-	//logger.Warnf("%v", msg.Attrs)
-	//logger.Warnf("%v %v %v %v %v", msg.SoapEnv, msg.SoapEnc, msg.Xsd, msg.Xsi, msg.Cwmp)
-
-	if msg != nil {
-		if msg.Body.Inform != nil {
-			// logger.Warn("debug", zap.String("inform", string(body)))
-			if err := s.handler.HandleInform(ctx, msg.Body.Inform); err != nil {
-				err = errors.Wrap(err, "handle Inform")
-				msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		for _, chunk := range chunks {
+			msg := &proto.SoapEnvelope{}
+			if err := xml.Unmarshal(chunk, msg); err != nil {
 				s.logger.Error("handle post", zap.Error(err))
-				c.Response().Header().Set("Content-Type", contentType)
-				return c.XML(http.StatusOK, msg2)
+				s.logger.Debug("debug", zap.String("body", string(chunk)))
+				return echo.NewHTTPError(http.StatusBadRequest, errors.Wrap(err, "unmarshal xml").Error())
 			}
-			sess.Options = &sessions.Options{
-				Path:     "/acs",
-				MaxAge:   1800,
-				HttpOnly: true,
-			}
-			sess.Values["OUI"] = msg.Body.Inform.DeviceID.OUI
-			sess.Values["ProductClass"] = msg.Body.Inform.DeviceID.ProductClass
-			sess.Values["SerialNumber"] = msg.Body.Inform.DeviceID.SerialNumber
-			sess.Values["SoapNamespace"] = msg.NS.ToString()
-			sess.Values["ContentType"] = contentType
-			sess.Save(c.Request(), c.Response())
-
-			msg2 := proto.CreateEnvelope(msg.Header.ID.Text, msg.NS, &proto.InformResponse{MaxEnvelopes: 1})
-			c.Response().Header().Set("Content-Type", contentType)
-			return c.XML(http.StatusOK, msg2)
-		}
-	}
-	var ns proto.SoapNamespace
-	var hasNS bool = false
-	if v, ok := sess.Values["SoapNamespace"]; ok && v != nil {
-		if v2, ok := v.(string); ok {
-			ns.FromString(v2)
-			hasNS = true
+			msg.Decode()
+			bodyElement, _ := proto.GetBodyElementName(chunk)
+			msgs = append(msgs, msg)
+			bodyElements = append(bodyElements, bodyElement)
 		}
 	}
-	if !hasNS {
-		return c.NoContent(http.StatusOK)
-	}
-
-	device := s.getDeviceBySession(sess)
-	if device == nil {
-		sess.Save(c.Request(), c.Response())
-		err := errors.New("invalid session")
+	// the limit was announced in the InformResponse, nothing of a larger POST is processed
+	if len(msgs) > s.getMaxEnvelopes() {
+		err := errors.Errorf("%v envelopes exceed MaxEnvelopes %v", len(msgs), s.getMaxEnvelopes())
 		s.logger.Error("handle post", zap.Error(err))
-		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		msg2 := proto.CreateEnvelopeFault(msgs[0].Header.ID.Text, msgs[0].NS, proto.ACSFaultCodeInvalidArguments, err)
 		return s.responseXML(c, sess, msg2)
 	}
-	product := device.GetProduct()
-	if product == nil {
-		s.logger.Error("unknow product")
-		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
-		return s.responseXML(c, sess, msg2)
+	//logger.Warnf("%v", msg.Attrs)
+	//logger.Warnf("%v %v %v %v %v", msg.SoapEnv, msg.SoapEnc, msg.Xsd, msg.Xsi, msg.Cwmp)
+
+	// without a token the Inform is redirected to a session URL
+	if s.options.SessionTracking == SessionTrackingURLToken && getSessionToken(r) == "" {
+		for _, msg := range msgs {
+			if msg.Body.Inform != nil {
+				location := c.Scheme() + "://" + r.Host + strings.TrimSuffix(r.URL.Path, "/") + sessionTokenPath + newSessionID()
+				return c.Redirect(http.StatusTemporaryRedirect, location)
+			}
+		}
 	}
 
-	if msg != nil {
-		if msg.Body.TransferComplete != nil {
-			if err := s.handler.HandleTransferComplete(ctx, device, msg.Body.TransferComplete); err != nil {
-				err = errors.Wrap(err, "handle TransferComplete")
+	// answer the envelopes in order
+	session := s.getSession(sess)
+	if session.GetState() != SessionStateNew && cast.ToString(sess.Values["AuthUsername"]) != cast.ToString(c.Get(authUsernameKey)) {
+		s.logger.Warn("session of another user", zap.String("session", session.ID))
+		return echo.ErrUnauthorized
+	}
+	responses := []*proto.SoapEnvelope{}
+	var device Device
+	for i, msg := range msgs {
+		// unsupported methods are refused before the session or device is touched
+		if !isSupportedBodyElement(bodyElements[i]) {
+			err := errors.Errorf("unsupported method %v", bodyElements[i])
+			s.logger.Error("handle post", zap.Error(err))
+			msg2 := proto.CreateEnvelopeFaultWithDetail(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeMethodNotSupported, err)
+			responses = append(responses, msg2)
+			continue
+		}
+		if msg.Body.Inform != nil {
+			switch session.GetState() {
+			case SessionStateACSDone:
+				// the CPE closed the previous session without an empty POST
+				s.closeSession(ctx, session)
+				session = newSession()
+			case SessionStateClosing:
+				session = newSession()
+			}
+			timeout := s.getSessionTimeout()
+			if v := msg.Header.SessionTimeout; v != nil {
+				if seconds := cast.ToInt(strings.TrimSpace(v.Text)); seconds > 0 {
+					timeout = time.Duration(seconds) * time.Second
+				}
+			}
+			// a second Inform is refused below and must not replace the device
+			if session.GetState() == SessionStateNew {
+				deviceID := msg.Body.Inform.DeviceID
+				session.setDevice(deviceID.OUI, deviceID.ProductClass, deviceID.SerialNumber, timeout)
+			}
+			if err := s.transitSession(ctx, session, SessionEventInform); err != nil {
 				s.logger.Error("handle post", zap.Error(err))
-				msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
-				return s.responseXML(c, sess, msg2)
+				msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeRequestDenied, err)
+				responses = append(responses, msg2)
+				continue
+			}
+			s.closeDeviceSessions(ctx, session)
+			sess.Values["SessionID"] = session.ID
+			msg2 := s.handleInform(c, sess, msg)
+			if msg2.Body.Fault != nil {
+				s.closeSession(ctx, session)
 			}
-			msg2 := proto.CreateEnvelope(msg.Header.ID.Text, msg.NS, &proto.TransferCompleteResponse{})
-			return s.responseXML(c, sess, msg2)
+			responses = append(responses, msg2)
+			continue
 		}
-		if msg.Body.AutonomousTransferComplete != nil {
-			if err := s.handler.HandleAutonomousTransferComplete(ctx, device, msg.Body.AutonomousTransferComplete); err != nil {
-				err = errors.Wrap(err, "handle AutonomousTransferComplete")
+		event := SessionEventCPEResponse
+		if isRequestBodyElement(bodyElements[i]) {
+			event = SessionEventCPERequest
+		}
+		if err := s.transitSession(ctx, session, event); err != nil {
+			s.logger.Error("handle post", zap.Error(err))
+			msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeRequestDenied, err)
+			responses = append(responses, msg2)
+			continue
+		}
+		if s.options.HoldRequests && getHoldRequests(sess) && isACSRPCMethod(bodyElements[i]) {
+			s.logger.Warn("cpe request while holding requests", zap.String("method", bodyElements[i]))
+		}
+		if device == nil {
+			device, err = s.getSessionDevice(c, sess)
+			if err != nil {
 				s.logger.Error("handle post", zap.Error(err))
 				msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
-				return s.responseXML(c, sess, msg2)
+				responses = append(responses, msg2)
+				continue
 			}
-			msg2 := proto.CreateEnvelope(msg.Header.ID.Text, msg.NS, &proto.AutonomousTransferCompleteResponse{})
-			return s.responseXML(c, sess, msg2)
 		}
-		if err2 := s.handler.HandleFault(device, msg.Header.ID.Text, msg.Body.Fault); err2 != nil {
-			s.logger.Error("handle SoapFault", zap.Error(err2))
+		if msg2 := s.handleMessage(ctx, device, msg); msg2 != nil {
+			responses = append(responses, msg2)
 		}
+	}
+	if len(responses) > 0 {
+		sess.Save(c.Request(), c.Response())
+		return s.responseXML(c, sess, responses...)
+	}
 
-		if err := s.handler.HandleGetRPCMethodsResponse(ctx, device, msg.Header.ID.Text, msg.Body.GetRPCMethodsResponse); err != nil {
-			err = errors.Wrap(err, "handle GetRPCMethodsResponse")
+	if len(msgs) == 0 {
+		if err := s.transitSession(ctx, session, SessionEventEmptyPost); err != nil {
 			s.logger.Error("handle post", zap.Error(err))
-			msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
-			return s.responseXML(c, sess, msg2)
+			s.endSession(c, sess, session)
+			return c.NoContent(http.StatusNoContent)
 		}
-		if err := s.handler.HandleGetParameterValuesResponse(ctx, device, msg.Header.ID.Text, msg.Body.GetParameterValuesResponse); err != nil {
-			err = errors.Wrap(err, "handle GetParameterValuesResponse")
+	}
+	ns, ok := getSessionNamespace(sess)
+	if !ok {
+		s.endSession(c, sess, session)
+		return c.NoContent(http.StatusNoContent)
+	}
+	if device == nil {
+		device, err = s.getSessionDevice(c, sess)
+		if err != nil {
 			s.logger.Error("handle post", zap.Error(err))
-			msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
-			return s.responseXML(c, sess, msg2)
+			s.endSession(c, sess, session)
+			return c.NoContent(http.StatusNoContent)
 		}
-		if err := s.handler.HandleSetParameterValuesResponse(ctx, device, msg.Header.ID.Text, msg.Body.SetParameterValuesResponse); err != nil {
-			err = errors.Wrap(err, "handle SetParameterValuesResponse")
-			s.logger.Error("handle post", zap.Error(err))
-			msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
-			return s.responseXML(c, sess, msg2)
+	}
+
+	// send queued requests, up to the MaxEnvelopes of the Inform
+	maxEnvelopes := cast.ToInt(sess.Values["MaxEnvelopes"])
+	if maxEnvelopes < 1 {
+		maxEnvelopes = 1
+	}
+	for len(responses) < maxEnvelopes {
+		msg2 := s.getNextMessage(ns, device)
+		if msg2 == nil {
+			break
 		}
-		if err := s.handler.HandleGetParameterNamesResponse(ctx, device, msg.Header.ID.Text, msg.Body.GetParameterNamesResponse); err != nil {
-			err = errors.Wrap(err, "handle GetParameterNamesResponse")
+		responses = append(responses, msg2)
+	}
+	if s.options.HoldRequests {
+		// hold only while calls remain queued, the last request releases the
+		// CPE, which sends its held requests before its empty POST
+		s.setHoldRequests(c, sess, device.GetNextMethodCall() != nil)
+	}
+	if len(responses) > 0 {
+		s.transitSession(ctx, session, SessionEventACSRequest)
+		sess.Save(c.Request(), c.Response())
+		return s.responseXML(c, sess, responses...)
+	}
+	// the session ends when neither side has anything left, otherwise the CPE
+	// may still send the requests it held back
+	if session.GetState() == SessionStateEmptyPost {
+		s.endSession(c, sess, session)
+		return c.NoContent(http.StatusNoContent)
+	}
+	s.transitSession(ctx, session, SessionEventACSDone)
+	sess.Save(c.Request(), c.Response())
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (s *AcsServer) handleInform(c echo.Context, sess *sessions.Session, msg *proto.SoapEnvelope) *proto.SoapEnvelope {
+	ctx := c.Request().Context()
+	contentType := c.Request().Header.Get("Content-Type")
+
+	// the InformResponse uses the namespace of the Inform, later
+	// envelopes use the namespace of the negotiated version
+	sessNS := msg.NS
+	version := proto.GetCwmpVersion(msg.NS.Cwmp.Value)
+	var useVersion *proto.UseCWMPVersion
+	if v := msg.Header.SupportedCWMPVersions; v != nil {
+		version = s.negotiateCWMPVersion(v.Text)
+		if version == "" {
+			err := errors.Errorf("no supported cwmp version in %v", v.Text)
 			s.logger.Error("handle post", zap.Error(err))
-			msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
-			return s.responseXML(c, sess, msg2)
+			msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeRequestDenied, err)
+			return msg2
+		}
+		sessNS.Cwmp.Value = proto.GetCwmpNamespace(version)
+		useVersion = &proto.UseCWMPVersion{Text: version}
+		useVersion.Attrs = []xml.Attr{
+			{
+				Name:  xml.Name{Space: "", Local: "mustUnderstand"},
+				Value: "1",
+			},
 		}
-		if err := s.handler.HandleSetParameterAttributesResponse(ctx, device, msg.Header.ID.Text, msg.Body.SetParameterAttributesResponse); err != nil {
-			err = errors.Wrap(err, "handle SetParameterAttributesResponse")
+	} else if maxVersion := s.getMaxCWMPVersion(); version != "" && proto.CompareCwmpVersions(version, maxVersion) > 0 && proto.GetCwmpNamespace(maxVersion) != "" {
+		// without SupportedCWMPVersions the version of the Inform is used,
+		// capped at MaxCWMPVersion
+		version = maxVersion
+		sessNS.Cwmp.Value = proto.GetCwmpNamespace(version)
+	}
+
+	// per device credentials only open sessions for their own device
+	username := cast.ToString(c.Get(authUsernameKey))
+	if p := s.options.CredentialsProvider; p != nil && username != "" {
+		if err := p.CheckDevice(ctx, username, &msg.Body.Inform.DeviceID); err != nil {
+			err = errors.Wrapf(err, "check device of user %v", username)
 			s.logger.Error("handle post", zap.Error(err))
-			msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
-			return s.responseXML(c, sess, msg2)
+			msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeRequestDenied, err)
+			return msg2
 		}
-		if err := s.handler.HandleGetParameterAttributesResponse(ctx, device, msg.Header.ID.Text, msg.Body.GetParameterAttributesResponse); err != nil {
-			err = errors.Wrap(err, "handle GetParameterAttributesResponse")
+	}
+
+	// the client certificate only opens sessions for its own device
+	if s.options.AuthType == AuthTypeClientCert {
+		identities, _ := c.Get(authCertIdentitiesKey).([]string)
+		if err := checkCertIdentities(identities, &msg.Body.Inform.DeviceID); err != nil {
 			s.logger.Error("handle post", zap.Error(err))
-			msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
-			return s.responseXML(c, sess, msg2)
+			msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeRequestDenied, err)
+			return msg2
 		}
-		if err := s.handler.HandleAddObjectResponse(ctx, device, msg.Header.ID.Text, msg.Body.AddObjectResponse); err != nil {
-			err = errors.Wrap(err, "handle AddObjectResponse")
+	}
+
+	if err := s.handler.HandleInform(ctx, msg.Body.Inform); err != nil {
+		err = errors.Wrap(err, "handle Inform")
+		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		s.logger.Error("handle post", zap.Error(err))
+		return msg2
+	}
+
+	sess.Options = newSessionOptions()
+	sess.Values["OUI"] = msg.Body.Inform.DeviceID.OUI
+	sess.Values["ProductClass"] = msg.Body.Inform.DeviceID.ProductClass
+	sess.Values["SerialNumber"] = msg.Body.Inform.DeviceID.SerialNumber
+	sess.Values["SoapNamespace"] = sessNS.ToString()
+	sess.Values["CWMPVersion"] = version
+	sess.Values["HoldRequests"] = false
+	if s.options.HoldRequests {
+		// the InformResponse already holds the CPE's requests if calls are queued
+		if device := s.getDeviceBySession(sess); device != nil {
+			sess.Values["HoldRequests"] = device.GetNextMethodCall() != nil
+		}
+	}
+	sess.Values["MaxEnvelopes"] = msg.Body.Inform.MaxEnvelopes
+	sess.Values["ContentType"] = contentType
+	sess.Values["AuthUsername"] = username
+	sess.Save(c.Request(), c.Response())
+
+	msg2 := proto.CreateEnvelope(msg.Header.ID.Text, msg.NS, &proto.InformResponse{MaxEnvelopes: s.getMaxEnvelopes()})
+	if useVersion != nil {
+		msg2.Header.UseCWMPVersion = useVersion
+		msg2.Encode()
+	}
+	return msg2
+}
+
+func (s *AcsServer) handleMessage(ctx context.Context, device Device, msg *proto.SoapEnvelope) *proto.SoapEnvelope {
+	if msg.Body.GetRPCMethods != nil {
+		resp := &proto.GetRPCMethodsResponse{}
+		resp.MethodList.Strings = acsRPCMethods
+		msg2 := proto.CreateEnvelope(msg.Header.ID.Text, msg.NS, resp)
+		return msg2
+	}
+	if msg.Body.TransferComplete != nil {
+		if err := s.handler.HandleTransferComplete(ctx, device, msg.Body.TransferComplete); err != nil {
+			err = errors.Wrap(err, "handle TransferComplete")
 			s.logger.Error("handle post", zap.Error(err))
 			msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
-			return s.responseXML(c, sess, msg2)
+			return msg2
 		}
-		if err := s.handler.HandleDeleteObjectResponse(ctx, device, msg.Header.ID.Text, msg.Body.DeleteObjectResponse); err != nil {
-			err = errors.Wrap(err, "handle DeleteObjectResponse")
+		msg2 := proto.CreateEnvelope(msg.Header.ID.Text, msg.NS, &proto.TransferCompleteResponse{})
+		return msg2
+	}
+	if msg.Body.AutonomousTransferComplete != nil {
+		if err := s.handler.HandleAutonomousTransferComplete(ctx, device, msg.Body.AutonomousTransferComplete); err != nil {
+			err = errors.Wrap(err, "handle AutonomousTransferComplete")
 			s.logger.Error("handle post", zap.Error(err))
 			msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
-			return s.responseXML(c, sess, msg2)
+			return msg2
 		}
-		if err := s.handler.HandleDownloadResponse(ctx, device, msg.Header.ID.Text, msg.Body.DownloadResponse); err != nil {
-			err = errors.Wrap(err, "handle DownloadResponse")
+		msg2 := proto.CreateEnvelope(msg.Header.ID.Text, msg.NS, &proto.AutonomousTransferCompleteResponse{})
+		return msg2
+	}
+	if msg.Body.DUStateChangeComplete != nil {
+		if err := s.handler.HandleDUStateChangeComplete(ctx, device, msg.Body.DUStateChangeComplete); err != nil {
+			err = errors.Wrap(err, "handle DUStateChangeComplete")
 			s.logger.Error("handle post", zap.Error(err))
 			msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
-			return s.responseXML(c, sess, msg2)
+			return msg2
 		}
-		if err := s.handler.HandleUploadResponse(ctx, device, msg.Header.ID.Text, msg.Body.UploadResponse); err != nil {
-			err = errors.Wrap(err, "handle UploadResponse")
+		msg2 := proto.CreateEnvelope(msg.Header.ID.Text, msg.NS, &proto.DUStateChangeCompleteResponse{})
+		return msg2
+	}
+	if msg.Body.AutonomousDUStateChangeComplete != nil {
+		if err := s.handler.HandleAutonomousDUStateChangeComplete(ctx, device, msg.Body.AutonomousDUStateChangeComplete); err != nil {
+			err = errors.Wrap(err, "handle AutonomousDUStateChangeComplete")
 			s.logger.Error("handle post", zap.Error(err))
 			msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
-			return s.responseXML(c, sess, msg2)
+			return msg2
 		}
-		if err := s.handler.HandleRebootResponse(ctx, device, msg.Header.ID.Text, msg.Body.RebootResponse); err != nil {
-			err = errors.Wrap(err, "handle RebootResponse")
+		msg2 := proto.CreateEnvelope(msg.Header.ID.Text, msg.NS, &proto.AutonomousDUStateChangeCompleteResponse{})
+		return msg2
+	}
+	if msg.Body.RequestDownload != nil {
+		if err := s.handler.HandleRequestDownload(ctx, device, msg.Body.RequestDownload); err != nil {
+			err = errors.Wrap(err, "handle RequestDownload")
 			s.logger.Error("handle post", zap.Error(err))
 			msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
-			return s.responseXML(c, sess, msg2)
+			return msg2
 		}
-		if err := s.handler.HandleFactoryResetResponse(ctx, device, msg.Header.ID.Text, msg.Body.FactoryResetResponse); err != nil {
-			err = errors.Wrap(err, "handle FactoryResetResponse")
+		msg2 := proto.CreateEnvelope(msg.Header.ID.Text, msg.NS, &proto.RequestDownloadResponse{})
+		return msg2
+	}
+	if msg.Body.Kicked != nil {
+		nextURL, err := s.handler.HandleKicked(ctx, device, msg.Body.Kicked)
+		if err != nil {
+			err = errors.Wrap(err, "handle Kicked")
 			s.logger.Error("handle post", zap.Error(err))
 			msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
-			return s.responseXML(c, sess, msg2)
+			return msg2
 		}
+		msg2 := proto.CreateEnvelope(msg.Header.ID.Text, msg.NS, &proto.KickedResponse{NextURL: nextURL})
+		return msg2
+	}
+	if err2 := s.handler.HandleFault(device, msg.Header.ID.Text, msg.Body.Fault); err2 != nil {
+		s.logger.Error("handle SoapFault", zap.Error(err2))
+	}
 
-		if v := msg.Body.TransferComplete; v != nil {
-			s.logger.Warn("TransferComplete")
-		}
-		if v := msg.Body.AutonomousTransferComplete; v != nil {
-			s.logger.Warn("AutonomousTransferComplete")
-		}
+	if err := s.handler.HandleGetRPCMethodsResponse(ctx, device, msg.Header.ID.Text, msg.Body.GetRPCMethodsResponse); err != nil {
+		err = errors.Wrap(err, "handle GetRPCMethodsResponse")
+		s.logger.Error("handle post", zap.Error(err))
+		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		return msg2
+	}
+	if err := s.handler.HandleGetParameterValuesResponse(ctx, device, msg.Header.ID.Text, msg.Body.GetParameterValuesResponse); err != nil {
+		err = errors.Wrap(err, "handle GetParameterValuesResponse")
+		s.logger.Error("handle post", zap.Error(err))
+		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		return msg2
+	}
+	if err := s.handler.HandleSetParameterValuesResponse(ctx, device, msg.Header.ID.Text, msg.Body.SetParameterValuesResponse); err != nil {
+		err = errors.Wrap(err, "handle SetParameterValuesResponse")
+		s.logger.Error("handle post", zap.Error(err))
+		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		return msg2
+	}
+	if err := s.handler.HandleGetParameterNamesResponse(ctx, device, msg.Header.ID.Text, msg.Body.GetParameterNamesResponse); err != nil {
+		err = errors.Wrap(err, "handle GetParameterNamesResponse")
+		s.logger.Error("handle post", zap.Error(err))
+		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		return msg2
+	}
+	if err := s.handler.HandleSetParameterAttributesResponse(ctx, device, msg.Header.ID.Text, msg.Body.SetParameterAttributesResponse); err != nil {
+		err = errors.Wrap(err, "handle SetParameterAttributesResponse")
+		s.logger.Error("handle post", zap.Error(err))
+		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		return msg2
+	}
+	if err := s.handler.HandleGetParameterAttributesResponse(ctx, device, msg.Header.ID.Text, msg.Body.GetParameterAttributesResponse); err != nil {
+		err = errors.Wrap(err, "handle GetParameterAttributesResponse")
+		s.logger.Error("handle post", zap.Error(err))
+		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		return msg2
+	}
+	if err := s.handler.HandleAddObjectResponse(ctx, device, msg.Header.ID.Text, msg.Body.AddObjectResponse); err != nil {
+		err = errors.Wrap(err, "handle AddObjectResponse")
+		s.logger.Error("handle post", zap.Error(err))
+		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		return msg2
+	}
+	if err := s.handler.HandleDeleteObjectResponse(ctx, device, msg.Header.ID.Text, msg.Body.DeleteObjectResponse); err != nil {
+		err = errors.Wrap(err, "handle DeleteObjectResponse")
+		s.logger.Error("handle post", zap.Error(err))
+		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		return msg2
+	}
+	if err := s.handler.HandleDownloadResponse(ctx, device, msg.Header.ID.Text, msg.Body.DownloadResponse); err != nil {
+		err = errors.Wrap(err, "handle DownloadResponse")
+		s.logger.Error("handle post", zap.Error(err))
+		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		return msg2
+	}
+	if err := s.handler.HandleUploadResponse(ctx, device, msg.Header.ID.Text, msg.Body.UploadResponse); err != nil {
+		err = errors.Wrap(err, "handle UploadResponse")
+		s.logger.Error("handle post", zap.Error(err))
+		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		return msg2
+	}
+	if err := s.handler.HandleRebootResponse(ctx, device, msg.Header.ID.Text, msg.Body.RebootResponse); err != nil {
+		err = errors.Wrap(err, "handle RebootResponse")
+		s.logger.Error("handle post", zap.Error(err))
+		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		return msg2
+	}
+	if err := s.handler.HandleFactoryResetResponse(ctx, device, msg.Header.ID.Text, msg.Body.FactoryResetResponse); err != nil {
+		err = errors.Wrap(err, "handle FactoryResetResponse")
+		s.logger.Error("handle post", zap.Error(err))
+		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		return msg2
+	}
+	if err := s.handler.HandleScheduleInformResponse(ctx, device, msg.Header.ID.Text, msg.Body.ScheduleInformResponse); err != nil {
+		err = errors.Wrap(err, "handle ScheduleInformResponse")
+		s.logger.Error("handle post", zap.Error(err))
+		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		return msg2
+	}
+	if err := s.handler.HandleScheduleDownloadResponse(ctx, device, msg.Header.ID.Text, msg.Body.ScheduleDownloadResponse); err != nil {
+		err = errors.Wrap(err, "handle ScheduleDownloadResponse")
+		s.logger.Error("handle post", zap.Error(err))
+		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		return msg2
+	}
+	if err := s.handler.HandleChangeDUStateResponse(ctx, device, msg.Header.ID.Text, msg.Body.ChangeDUStateResponse); err != nil {
+		err = errors.Wrap(err, "handle ChangeDUStateResponse")
+		s.logger.Error("handle post", zap.Error(err))
+		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		return msg2
+	}
+	if err := s.handler.HandleGetQueuedTransfersResponse(ctx, device, msg.Header.ID.Text, msg.Body.GetQueuedTransfersResponse); err != nil {
+		err = errors.Wrap(err, "handle GetQueuedTransfersResponse")
+		s.logger.Error("handle post", zap.Error(err))
+		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		return msg2
+	}
+	if err := s.handler.HandleGetAllQueuedTransfersResponse(ctx, device, msg.Header.ID.Text, msg.Body.GetAllQueuedTransfersResponse); err != nil {
+		err = errors.Wrap(err, "handle GetAllQueuedTransfersResponse")
+		s.logger.Error("handle post", zap.Error(err))
+		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		return msg2
+	}
+	if err := s.handler.HandleCancelTransferResponse(ctx, device, msg.Header.ID.Text, msg.Body.CancelTransferResponse); err != nil {
+		err = errors.Wrap(err, "handle CancelTransferResponse")
+		s.logger.Error("handle post", zap.Error(err))
+		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		return msg2
+	}
+	if err := s.handler.HandleSetVouchersResponse(ctx, device, msg.Header.ID.Text, msg.Body.SetVouchersResponse); err != nil {
+		err = errors.Wrap(err, "handle SetVouchersResponse")
+		s.logger.Error("handle post", zap.Error(err))
+		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		return msg2
+	}
+	if err := s.handler.HandleGetOptionsResponse(ctx, device, msg.Header.ID.Text, msg.Body.GetOptionsResponse); err != nil {
+		err = errors.Wrap(err, "handle GetOptionsResponse")
+		s.logger.Error("handle post", zap.Error(err))
+		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		return msg2
+	}
+	if err := s.handler.HandleRawResponse(ctx, device, msg.Header.ID.Text, msg.Body.Raw); err != nil {
+		err = errors.Wrap(err, "handle RawResponse")
+		s.logger.Error("handle post", zap.Error(err))
+		msg2 := proto.CreateEnvelopeFault(msg.Header.ID.Text, msg.NS, proto.ACSFaultCodeInternalError, err)
+		return msg2
 	}
 
-	msg2 := s.getNextMessage(ns, device)
-	if msg2 != nil {
-		sess.Save(c.Request(), c.Response())
-		return s.responseXML(c, sess, msg2)
+	if v := msg.Body.TransferComplete; v != nil {
+		s.logger.Warn("TransferComplete")
+	}
+	if v := msg.Body.AutonomousTransferComplete; v != nil {
+		s.logger.Warn("AutonomousTransferComplete")
 	}
-	return c.NoContent(http.StatusOK)
+	return nil
 }
 
 func (s *AcsServer) getNextMessage(ns proto.SoapNamespace, device Device) *proto.SoapEnvelope {
@@ -352,7 +665,116 @@ func (s *AcsServer) getNextMessage(ns proto.SoapNamespace, device Device) *proto
 			}
 		case "FactoryReset":
 			body = &proto.FactoryReset{}
+		case "ScheduleInform":
+			delaySeconds := cast.ToUint(call.GetRequestValue("DelaySeconds"))
+			body = &proto.ScheduleInform{
+				DelaySeconds: delaySeconds,
+				CommandKey:   commandKey,
+			}
+		case "ScheduleDownload":
+			url := call.GetRequestValue("Url")
+			username := call.GetRequestValue("Username")
+			password := call.GetRequestValue("Password")
+			fileType := call.GetRequestValue("FileType")
+			fileSize := cast.ToUint(call.GetRequestValue("FileSize"))
+			targetFileName := call.GetRequestValue("TargetFileName")
+
+			tmp := &proto.ScheduleDownload{
+				CommandKey:     commandKey,
+				URL:            url,
+				Username:       username,
+				Password:       password,
+				FileType:       fileType,
+				FileSize:       fileSize,
+				TargetFileName: targetFileName,
+			}
+			// TimeWindowList.{i}.WindowStart, TimeWindowList.{i}.WindowEnd, ...
+			for _, v := range getIndexedRequestValues(values, "TimeWindowList") {
+				tmp.TimeWindowList.TimeWindowStructs = append(tmp.TimeWindowList.TimeWindowStructs, &proto.TimeWindowStruct{
+					WindowStart: cast.ToUint(v["WindowStart"]),
+					WindowEnd:   cast.ToUint(v["WindowEnd"]),
+					WindowMode:  v["WindowMode"],
+					UserMessage: v["UserMessage"],
+					MaxRetries:  cast.ToInt(v["MaxRetries"]),
+				})
+			}
+			body = tmp
+		case "ChangeDUState":
+			tmp := &proto.ChangeDUState{
+				CommandKey: commandKey,
+			}
+			// Operations.{i}.Type is one of Install, Update or Uninstall
+			for _, v := range getIndexedRequestValues(values, "Operations") {
+				switch v["Type"] {
+				case "Install":
+					tmp.Operations.OperationStructs = append(tmp.Operations.OperationStructs, &proto.InstallOpStruct{
+						URL:             v["URL"],
+						UUID:            v["UUID"],
+						Username:        v["Username"],
+						Password:        v["Password"],
+						ExecutionEnvRef: v["ExecutionEnvRef"],
+					})
+				case "Update":
+					tmp.Operations.OperationStructs = append(tmp.Operations.OperationStructs, &proto.UpdateOpStruct{
+						UUID:     v["UUID"],
+						Version:  v["Version"],
+						URL:      v["URL"],
+						Username: v["Username"],
+						Password: v["Password"],
+					})
+				case "Uninstall":
+					tmp.Operations.OperationStructs = append(tmp.Operations.OperationStructs, &proto.UninstallOpStruct{
+						UUID:            v["UUID"],
+						Version:         v["Version"],
+						ExecutionEnvRef: v["ExecutionEnvRef"],
+					})
+				default:
+					s.logger.Warn("unsupported operation",
+						zap.String("method", methodName),
+						zap.String("command_key", commandKey),
+						zap.String("type", v["Type"]),
+					)
+				}
+			}
+			body = tmp
+		case "GetQueuedTransfers":
+			body = &proto.GetQueuedTransfers{}
+		case "GetAllQueuedTransfers":
+			body = &proto.GetAllQueuedTransfers{}
+		case "CancelTransfer":
+			body = &proto.CancelTransfer{
+				CommandKey: call.GetRequestValue("CommandKey"),
+			}
+		case "SetVouchers":
+			tmp := &proto.SetVouchers{}
+			// VoucherList.{i} holds a base64 encoded signed voucher
+			tmp.VoucherList.Base64s = getListRequestValues(values, "VoucherList")
+			body = tmp
+		case "GetOptions":
+			body = &proto.GetOptions{
+				OptionName: call.GetRequestValue("OptionName"),
+			}
 		default:
+			if isVendorMethod(methodName) {
+				// the request value "RawXML" is sent as the content of the
+				// method element, otherwise the request values become child elements
+				var err error
+				if raw := call.GetRequestValue("RawXML"); raw != "" {
+					body, err = proto.CreateRawBodyXML(methodName, raw)
+				} else {
+					body, err = proto.CreateRawBody(methodName, values)
+				}
+				if err != nil {
+					device.UpdateMethodCallUnknow(commandKey)
+					s.logger.Error("invalid vendor method",
+						zap.String("method", methodName),
+						zap.String("command_key", commandKey),
+						zap.Error(err),
+					)
+					return nil
+				}
+				break
+			}
 			device.UpdateMethodCallUnknow(commandKey)
 			s.logger.Warn("unsupported device method",
 				zap.String("method", methodName),
@@ -368,6 +790,172 @@ func (s *AcsServer) getNextMessage(ns proto.SoapNamespace, device Device) *proto
 	return nil
 }
 
+// getMaxEnvelopes returns the number of envelopes the ACS accepts in one POST.
+func (s *AcsServer) getMaxEnvelopes() int {
+	if s.options.MaxEnvelopes < 1 {
+		return 1
+	}
+	return s.options.MaxEnvelopes
+}
+
+// getMaxCWMPVersion returns the highest CWMP version the ACS uses.
+func (s *AcsServer) getMaxCWMPVersion() string {
+	if s.options.MaxCWMPVersion == "" {
+		return "1.4"
+	}
+	return s.options.MaxCWMPVersion
+}
+
+// negotiateCWMPVersion picks the highest version in the CPE's
+// SupportedCWMPVersions that does not exceed Options.MaxCWMPVersion.
+func (s *AcsServer) negotiateCWMPVersion(supported string) string {
+	maxVersion := s.getMaxCWMPVersion()
+	out := ""
+	for _, v := range proto.ParseCwmpVersions(supported) {
+		if proto.CompareCwmpVersions(v, maxVersion) <= 0 && (out == "" || proto.CompareCwmpVersions(v, out) > 0) {
+			out = v
+		}
+	}
+	return out
+}
+
+// isSupportedBodyElement reports whether name is a method the ACS accepts from
+// the CPE, a response to an ACS request or a fault.
+func isSupportedBodyElement(name string) bool {
+	if name == "" || name == "Fault" || strings.HasSuffix(name, "Response") {
+		return true
+	}
+	return isACSRPCMethod(name)
+}
+
+// isRequestBodyElement reports whether name is a request rather than a
+// response or a fault.
+func isRequestBodyElement(name string) bool {
+	return name != "" && name != "Fault" && !strings.HasSuffix(name, "Response")
+}
+
+func isACSRPCMethod(name string) bool {
+	for _, v := range acsRPCMethods {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+func getHoldRequests(sess *sessions.Session) bool {
+	return cast.ToBool(sess.Values["HoldRequests"])
+}
+
+// setHoldRequests records whether the envelopes sent to the CPE carry
+// HoldRequests, which forbids the CPE to send requests until it is released.
+func (s *AcsServer) setHoldRequests(c echo.Context, sess *sessions.Session, hold bool) {
+	if getHoldRequests(sess) == hold {
+		return
+	}
+	if hold {
+		s.logger.Debug("hold requests")
+	} else {
+		s.logger.Debug("release requests")
+	}
+	sess.Values["HoldRequests"] = hold
+	sess.Save(c.Request(), c.Response())
+}
+
+// isVendorMethod reports whether name is a vendor specific method, named
+// X_<OUI>_<Method>.
+func isVendorMethod(name string) bool {
+	return strings.HasPrefix(name, "X_")
+}
+
+// getIndexedRequestValues groups request values named "<prefix>.<index>.<name>"
+// by index, ordered by index.
+func getIndexedRequestValues(values map[string]string, prefix string) []map[string]string {
+	groups := map[int]map[string]string{}
+	for k, v := range values {
+		parts := strings.SplitN(k, ".", 3)
+		if len(parts) != 3 || parts[0] != prefix {
+			continue
+		}
+		index, err := strconv.Atoi(parts[1])
+		if err != nil {
+			continue
+		}
+		if _, ok := groups[index]; !ok {
+			groups[index] = map[string]string{}
+		}
+		groups[index][parts[2]] = v
+	}
+	indexes := []int{}
+	for index := range groups {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	out := []map[string]string{}
+	for _, index := range indexes {
+		out = append(out, groups[index])
+	}
+	return out
+}
+
+// getListRequestValues returns request values named "<prefix>.<index>",
+// ordered by index.
+func getListRequestValues(values map[string]string, prefix string) []string {
+	items := map[int]string{}
+	for k, v := range values {
+		parts := strings.SplitN(k, ".", 2)
+		if len(parts) != 2 || parts[0] != prefix {
+			continue
+		}
+		index, err := strconv.Atoi(parts[1])
+		if err != nil {
+			continue
+		}
+		items[index] = v
+	}
+	indexes := []int{}
+	for index := range items {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	out := []string{}
+	for _, index := range indexes {
+		out = append(out, items[index])
+	}
+	return out
+}
+
+func newSessionOptions() *sessions.Options {
+	return &sessions.Options{
+		Path:     "/acs",
+		MaxAge:   1800,
+		HttpOnly: true,
+	}
+}
+
+func getSessionNamespace(sess *sessions.Session) (proto.SoapNamespace, bool) {
+	var ns proto.SoapNamespace
+	if v, ok := sess.Values["SoapNamespace"]; ok && v != nil {
+		if v2, ok := v.(string); ok {
+			ns.FromString(v2)
+			return ns, true
+		}
+	}
+	return ns, false
+}
+
+// getSessionDevice returns the device of the session.
+func (s *AcsServer) getSessionDevice(c echo.Context, sess *sessions.Session) (Device, error) {
+	device := s.getDeviceBySession(sess)
+	if device == nil {
+		return nil, errors.New("invalid session")
+	}
+	if device.GetProduct() == nil {
+		return nil, errors.New("unknow product")
+	}
+	return device, nil
+}
+
 func (s *AcsServer) getDeviceBySession(sess *sessions.Session) Device {
 	oui := cast.ToString(sess.Values["OUI"])
 	productClass := cast.ToString(sess.Values["ProductClass"])
@@ -375,11 +963,38 @@ func (s *AcsServer) getDeviceBySession(sess *sessions.Session) Device {
 	return s.handler.GetDevice("", oui, productClass, serialNumber)
 }
 
-func (s *AcsServer) responseXML(c echo.Context, sess *sessions.Session, i any) error {
+func (s *AcsServer) responseXML(c echo.Context, sess *sessions.Session, msgs ...*proto.SoapEnvelope) error {
+	contentType := c.Request().Header.Get("Content-Type")
 	if v, ok := sess.Values["ContentType"]; ok && v != nil {
 		if v2, ok := v.(string); ok {
-			c.Response().Header().Set("Content-Type", v2)
+			contentType = v2
+		}
+	}
+	if contentType != "" {
+		c.Response().Header().Set("Content-Type", contentType)
+	}
+	if getHoldRequests(sess) {
+		for _, msg := range msgs {
+			msg.Header.HoldRequests = &proto.HoldRequests{Text: "1"}
+			msg.Header.HoldRequests.Attrs = []xml.Attr{
+				{
+					Name:  xml.Name{Space: "", Local: "mustUnderstand"},
+					Value: "1",
+				},
+			}
+			msg.Encode()
+		}
+	}
+	if len(msgs) == 1 {
+		return c.XML(http.StatusOK, msgs[0])
+	}
+	data := []byte(xml.Header)
+	for _, msg := range msgs {
+		v, err := xml.Marshal(msg)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, errors.Wrap(err, "marshal xml").Error())
 		}
+		data = append(data, v...)
 	}
-	return c.XML(http.StatusOK, i)
+	return c.Blob(http.StatusOK, echo.MIMEApplicationXMLCharsetUTF8, data)
 }
@@ -0,0 +1,565 @@
+package acs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+	"github.com/netdoop/cwmp/proto"
+)
+
+type testMethodCall struct {
+	name       string
+	commandKey string
+	values     map[string]string
+}
+
+func (m *testMethodCall) GetMethodName() string               { return m.name }
+func (m *testMethodCall) GetCommandKey() string               { return m.commandKey }
+func (m *testMethodCall) GetRequestValues() map[string]string { return m.values }
+func (m *testMethodCall) GetRequestValue(n string) string     { return m.values[n] }
+
+type testDataModel struct{}
+
+func (testDataModel) GetParameterType(name string) string { return "xsd:string" }
+
+type testProduct struct{}
+
+func (testProduct) GetDataModel() DataModel { return testDataModel{} }
+
+// testDevice hands out its queued calls in order.
+type testDevice struct {
+	mutex sync.Mutex
+	calls []*testMethodCall
+	sent  []string
+}
+
+func (d *testDevice) GetProduct() Product { return testProduct{} }
+
+func (d *testDevice) GetNextMethodCall() MethodCall {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(d.calls) == 0 {
+		return nil
+	}
+	return d.calls[0]
+}
+
+func (d *testDevice) GetMethodCall(commandKey string) MethodCall { return nil }
+
+func (d *testDevice) PushMethodCall(t time.Time, methodName string, values map[string]any) (MethodCall, error) {
+	return nil, nil
+}
+
+func (d *testDevice) UpdateMethodCallRequestSend(commandKey string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.sent = append(d.sent, commandKey)
+	d.calls = d.calls[1:]
+	return nil
+}
+
+func (d *testDevice) UpdateMethodCallResponse(commandKey string, values map[string]any, faultCode int, faultString string) error {
+	return nil
+}
+
+func (d *testDevice) UpdateMethodCallUnknow(commandKey string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.calls = d.calls[1:]
+	return nil
+}
+
+// testHandler serves one device and records the messages it handles.
+type testHandler struct {
+	mutex   sync.Mutex
+	device  *testDevice
+	handled []string
+}
+
+func (h *testHandler) handle(name string, v any) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.handled = append(h.handled, name)
+	return nil
+}
+
+func (h *testHandler) getHandled() []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]string(nil), h.handled...)
+}
+
+func (h *testHandler) GetProduct(schema string, oui string, productClass string) Product {
+	return testProduct{}
+}
+
+func (h *testHandler) GetDevice(schema string, oui string, productClass string, serialNumber string) Device {
+	if h.device == nil {
+		return nil
+	}
+	return h.device
+}
+
+func (h *testHandler) HandleInform(ctx context.Context, inform *proto.Inform) error {
+	return h.handle("Inform", inform)
+}
+
+func (h *testHandler) HandleFault(device Device, id string, v *proto.SoapFault) error {
+	if v == nil {
+		return nil
+	}
+	return h.handle("Fault", v)
+}
+
+func (h *testHandler) HandleTransferComplete(ctx context.Context, device Device, req *proto.TransferComplete) error {
+	return h.handle("TransferComplete", req)
+}
+
+func (h *testHandler) HandleAutonomousTransferComplete(ctx context.Context, device Device, req *proto.AutonomousTransferComplete) error {
+	return h.handle("AutonomousTransferComplete", req)
+}
+
+func (h *testHandler) HandleDUStateChangeComplete(ctx context.Context, device Device, req *proto.DUStateChangeComplete) error {
+	return h.handle("DUStateChangeComplete", req)
+}
+
+func (h *testHandler) HandleAutonomousDUStateChangeComplete(ctx context.Context, device Device, req *proto.AutonomousDUStateChangeComplete) error {
+	return h.handle("AutonomousDUStateChangeComplete", req)
+}
+
+func (h *testHandler) HandleRequestDownload(ctx context.Context, device Device, req *proto.RequestDownload) error {
+	return h.handle("RequestDownload", req)
+}
+
+func (h *testHandler) HandleKicked(ctx context.Context, device Device, req *proto.Kicked) (string, error) {
+	return "", h.handle("Kicked", req)
+}
+
+// handleTestResponse records the responses the ACS passes on, it is called with
+// nil for every other response type.
+func handleTestResponse[T any](h *testHandler, name string, resp *T) error {
+	if resp == nil {
+		return nil
+	}
+	return h.handle(name, resp)
+}
+
+func (h *testHandler) HandleGetRPCMethodsResponse(ctx context.Context, device Device, id string, resp *proto.GetRPCMethodsResponse) error {
+	return handleTestResponse(h, "GetRPCMethodsResponse", resp)
+}
+
+func (h *testHandler) HandleGetParameterValuesResponse(ctx context.Context, device Device, id string, resp *proto.GetParameterValuesResponse) error {
+	return handleTestResponse(h, "GetParameterValuesResponse", resp)
+}
+
+func (h *testHandler) HandleSetParameterValuesResponse(ctx context.Context, device Device, id string, resp *proto.SetParameterValuesResponse) error {
+	return handleTestResponse(h, "SetParameterValuesResponse", resp)
+}
+
+func (h *testHandler) HandleGetParameterNamesResponse(ctx context.Context, device Device, id string, resp *proto.GetParameterNamesResponse) error {
+	return handleTestResponse(h, "GetParameterNamesResponse", resp)
+}
+
+func (h *testHandler) HandleGetParameterAttributesResponse(ctx context.Context, device Device, id string, resp *proto.GetParameterAttributesResponse) error {
+	return handleTestResponse(h, "GetParameterAttributesResponse", resp)
+}
+
+func (h *testHandler) HandleSetParameterAttributesResponse(ctx context.Context, device Device, id string, resp *proto.SetParameterAttributesResponse) error {
+	return handleTestResponse(h, "SetParameterAttributesResponse", resp)
+}
+
+func (h *testHandler) HandleAddObjectResponse(ctx context.Context, device Device, id string, resp *proto.AddObjectResponse) error {
+	return handleTestResponse(h, "AddObjectResponse", resp)
+}
+
+func (h *testHandler) HandleDeleteObjectResponse(ctx context.Context, device Device, id string, resp *proto.DeleteObjectResponse) error {
+	return handleTestResponse(h, "DeleteObjectResponse", resp)
+}
+
+func (h *testHandler) HandleDownloadResponse(ctx context.Context, device Device, id string, resp *proto.DownloadResponse) error {
+	return handleTestResponse(h, "DownloadResponse", resp)
+}
+
+func (h *testHandler) HandleUploadResponse(ctx context.Context, device Device, id string, resp *proto.UploadResponse) error {
+	return handleTestResponse(h, "UploadResponse", resp)
+}
+
+func (h *testHandler) HandleRebootResponse(ctx context.Context, device Device, id string, resp *proto.RebootResponse) error {
+	return handleTestResponse(h, "RebootResponse", resp)
+}
+
+func (h *testHandler) HandleFactoryResetResponse(ctx context.Context, device Device, id string, resp *proto.FactoryResetResponse) error {
+	return handleTestResponse(h, "FactoryResetResponse", resp)
+}
+
+func (h *testHandler) HandleScheduleInformResponse(ctx context.Context, device Device, id string, resp *proto.ScheduleInformResponse) error {
+	return handleTestResponse(h, "ScheduleInformResponse", resp)
+}
+
+func (h *testHandler) HandleScheduleDownloadResponse(ctx context.Context, device Device, id string, resp *proto.ScheduleDownloadResponse) error {
+	return handleTestResponse(h, "ScheduleDownloadResponse", resp)
+}
+
+func (h *testHandler) HandleChangeDUStateResponse(ctx context.Context, device Device, id string, resp *proto.ChangeDUStateResponse) error {
+	return handleTestResponse(h, "ChangeDUStateResponse", resp)
+}
+
+func (h *testHandler) HandleGetQueuedTransfersResponse(ctx context.Context, device Device, id string, resp *proto.GetQueuedTransfersResponse) error {
+	return handleTestResponse(h, "GetQueuedTransfersResponse", resp)
+}
+
+func (h *testHandler) HandleGetAllQueuedTransfersResponse(ctx context.Context, device Device, id string, resp *proto.GetAllQueuedTransfersResponse) error {
+	return handleTestResponse(h, "GetAllQueuedTransfersResponse", resp)
+}
+
+func (h *testHandler) HandleCancelTransferResponse(ctx context.Context, device Device, id string, resp *proto.CancelTransferResponse) error {
+	return handleTestResponse(h, "CancelTransferResponse", resp)
+}
+
+func (h *testHandler) HandleSetVouchersResponse(ctx context.Context, device Device, id string, resp *proto.SetVouchersResponse) error {
+	return handleTestResponse(h, "SetVouchersResponse", resp)
+}
+
+func (h *testHandler) HandleGetOptionsResponse(ctx context.Context, device Device, id string, resp *proto.GetOptionsResponse) error {
+	return handleTestResponse(h, "GetOptionsResponse", resp)
+}
+
+func (h *testHandler) HandleRawResponse(ctx context.Context, device Device, id string, resp *proto.RawBody) error {
+	return handleTestResponse(h, "RawResponse", resp)
+}
+
+func (h *testHandler) HandleSessionTransition(ctx context.Context, session *Session, event SessionEvent, from SessionState, to SessionState) {
+}
+
+func (h *testHandler) HandleMesureValues(device Device, filename string, values map[string]any) {}
+
+// testCPE posts to an ACS and keeps its cookies.
+type testCPE struct {
+	t        *testing.T
+	client   *http.Client
+	url      string
+	username string
+	password string
+}
+
+// newTestACSHandler returns an ACS serving POSTs at /acs.
+func newTestACSHandler(t *testing.T, h *testHandler, opts Options) (*AcsServer, *echo.Echo) {
+	s := NewAcsServer(h, 0)
+	t.Cleanup(s.Close)
+	e := echo.New()
+	s.SetupPostEchoGroupWithOptions(e.Group("/acs"), sessions.NewCookieStore([]byte("secret")), opts)
+	return s, e
+}
+
+func newTestACS(t *testing.T, h *testHandler, opts Options) (*AcsServer, *testCPE) {
+	s, e := newTestACSHandler(t, h, opts)
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+	jar, _ := cookiejar.New(nil)
+	return s, &testCPE{t: t, client: &http.Client{Jar: jar}, url: srv.URL + "/acs"}
+}
+
+func (c *testCPE) post(body string) (int, string) {
+	c.t.Helper()
+	req, err := http.NewRequest(http.MethodPost, c.url, strings.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/xml")
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+// postExpect posts body and fails unless the response has status and
+// contains every string of contains.
+func (c *testCPE) postExpect(body string, status int, contains ...string) string {
+	c.t.Helper()
+	code, resp := c.post(body)
+	if code != status {
+		c.t.Fatalf("status %v, want %v: %s", code, status, resp)
+	}
+	for _, v := range contains {
+		if !strings.Contains(resp, v) {
+			c.t.Fatalf("response without %q: %s", v, resp)
+		}
+	}
+	return resp
+}
+
+func testEnvelope(id string, header string, body string) string {
+	return `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:soapenc="http://schemas.xmlsoap.org/soap/encoding/" xmlns:xsd="http://www.w3.org/2001/XMLSchema" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xmlns:cwmp="urn:dslforum-org:cwmp-1-0">` +
+		`<soap:Header><cwmp:ID soap:mustUnderstand="1">` + id + `</cwmp:ID>` + header + `</soap:Header>` +
+		`<soap:Body>` + body + `</soap:Body></soap:Envelope>`
+}
+
+func testInform(serialNumber string, maxEnvelopes int) string {
+	return fmt.Sprintf(`<cwmp:Inform><DeviceId><Manufacturer>M</Manufacturer><OUI>001122</OUI><ProductClass>Router</ProductClass><SerialNumber>%s</SerialNumber></DeviceId>`+
+		`<Event><EventStruct><EventCode>1 BOOT</EventCode><CommandKey></CommandKey></EventStruct></Event>`+
+		`<MaxEnvelopes>%d</MaxEnvelopes><CurrentTime>2020-01-01T00:00:00</CurrentTime><RetryCount>0</RetryCount><ParameterList></ParameterList></cwmp:Inform>`,
+		serialNumber, maxEnvelopes)
+}
+
+const testTransferComplete = `<cwmp:TransferComplete><CommandKey>dl</CommandKey><FaultStruct><FaultCode>0</FaultCode><FaultString></FaultString></FaultStruct>` +
+	`<StartTime>2020-01-01T00:00:00</StartTime><CompleteTime>2020-01-01T00:00:01</CompleteTime></cwmp:TransferComplete>`
+
+func TestHandlePostEndsSessionOnEmptyPost(t *testing.T) {
+	h := &testHandler{device: &testDevice{}}
+	s, cpe := newTestACS(t, h, Options{})
+
+	cpe.postExpect(testEnvelope("1", "", testInform("SN1", 1)), http.StatusOK, "InformResponse")
+	if !s.IsDeviceInSession("001122", "Router", "SN1") {
+		t.Fatal("no session after the Inform")
+	}
+	cpe.postExpect("", http.StatusNoContent)
+	if s.IsDeviceInSession("001122", "Router", "SN1") {
+		t.Fatal("session open after the empty POST was answered empty")
+	}
+}
+
+func TestHandlePostKeepsSessionAfterEmptyResponse(t *testing.T) {
+	h := &testHandler{device: &testDevice{calls: []*testMethodCall{{name: "Reboot", commandKey: "reboot"}}}}
+	s, cpe := newTestACS(t, h, Options{})
+
+	cpe.postExpect(testEnvelope("1", "", testInform("SN1", 1)), http.StatusOK, "InformResponse")
+	cpe.postExpect("", http.StatusOK, "Reboot")
+	cpe.postExpect(testEnvelope("reboot", "", `<cwmp:RebootResponse/>`), http.StatusNoContent)
+
+	// the CPE still has requests, the ACS's empty response does not end the session
+	if !s.IsDeviceInSession("001122", "Router", "SN1") {
+		t.Fatal("session ended by the empty response")
+	}
+	cpe.postExpect(testEnvelope("2", "", testTransferComplete), http.StatusOK, "TransferCompleteResponse")
+	cpe.postExpect("", http.StatusNoContent)
+	if s.IsDeviceInSession("001122", "Router", "SN1") {
+		t.Fatal("session open after the CPE's empty POST")
+	}
+	want := []string{"Inform", "RebootResponse", "TransferComplete"}
+	if got := h.getHandled(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("handled %v, want %v", got, want)
+	}
+}
+
+func TestHandlePostReleasedRequestsReachHandler(t *testing.T) {
+	h := &testHandler{device: &testDevice{calls: []*testMethodCall{
+		{name: "GetRPCMethods", commandKey: "rpc"},
+		{name: "Reboot", commandKey: "reboot"},
+	}}}
+	s, cpe := newTestACS(t, h, Options{HoldRequests: true})
+
+	cpe.postExpect(testEnvelope("1", "", testInform("SN1", 1)), http.StatusOK, "InformResponse", "HoldRequests")
+	cpe.postExpect("", http.StatusOK, "GetRPCMethods", "HoldRequests")
+	// the last queued call releases the CPE
+	resp := cpe.postExpect(testEnvelope("rpc", "", `<cwmp:GetRPCMethodsResponse><MethodList></MethodList></cwmp:GetRPCMethodsResponse>`), http.StatusOK, "Reboot")
+	if strings.Contains(resp, "HoldRequests") {
+		t.Fatalf("last request holds the CPE: %s", resp)
+	}
+	cpe.postExpect(testEnvelope("reboot", "", `<cwmp:RebootResponse/>`), http.StatusNoContent)
+
+	// the requests the CPE held back are handled after the release
+	cpe.postExpect(testEnvelope("2", "", testTransferComplete), http.StatusOK, "TransferCompleteResponse")
+	cpe.postExpect("", http.StatusNoContent)
+	want := []string{"Inform", "GetRPCMethodsResponse", "RebootResponse", "TransferComplete"}
+	if got := h.getHandled(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("handled %v, want %v", got, want)
+	}
+	if s.IsDeviceInSession("001122", "Router", "SN1") {
+		t.Fatal("session open after the CPE's empty POST")
+	}
+}
+
+func TestHandlePostSecondInformKeepsDevice(t *testing.T) {
+	h := &testHandler{device: &testDevice{}}
+	s, cpe := newTestACS(t, h, Options{})
+
+	cpe.postExpect(testEnvelope("1", "", testInform("SN1", 1)), http.StatusOK, "InformResponse")
+	cpe.postExpect(testEnvelope("2", "", testInform("SN9", 1)), http.StatusOK, "Fault")
+	if !s.IsDeviceInSession("001122", "Router", "SN1") {
+		t.Fatal("session of SN1 lost to the refused Inform")
+	}
+	if s.IsDeviceInSession("001122", "Router", "SN9") {
+		t.Fatal("refused Inform of SN9 took over the session")
+	}
+}
+
+func TestNegotiateCWMPVersion(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxVersion string
+		supported  string
+		want       string
+	}{
+		{"highest", "", "1.0,1.2,1.4", "1.4"},
+		{"unordered", "", "1.4,1.0,1.2", "1.4"},
+		{"capped", "1.2", "1.0,1.1,1.3,1.4", "1.1"},
+		{"max supported", "1.2", "1.2,1.4", "1.2"},
+		{"unknown versions", "", "1.0,1.9", "1.0"},
+		{"none below max", "1.1", "1.2,1.4", ""},
+		{"empty", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &AcsServer{options: Options{MaxCWMPVersion: tt.maxVersion}}
+			if got := s.negotiateCWMPVersion(tt.supported); got != tt.want {
+				t.Fatalf("version %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandlePostCWMPVersion(t *testing.T) {
+	inform14 := strings.Replace(testEnvelope("1", "", testInform("SN1", 1)), "cwmp-1-0", "cwmp-1-4", 1)
+	supported := `<cwmp:SupportedCWMPVersions>1.0,1.2,1.4</cwmp:SupportedCWMPVersions>`
+	tests := []struct {
+		name       string
+		maxVersion string
+		inform     string
+		use        string
+		namespace  string
+	}{
+		{"negotiated", "", strings.Replace(inform14, "</cwmp:ID>", "</cwmp:ID>"+supported, 1), "1.4", "cwmp-1-4"},
+		{"negotiated below max", "1.3", strings.Replace(inform14, "</cwmp:ID>", "</cwmp:ID>"+supported, 1), "1.2", "cwmp-1-2"},
+		{"inform version", "", inform14, "", "cwmp-1-4"},
+		{"inform version capped", "1.2", inform14, "", "cwmp-1-2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &testHandler{device: &testDevice{calls: []*testMethodCall{{name: "Reboot", commandKey: "reboot"}}}}
+			_, cpe := newTestACS(t, h, Options{MaxCWMPVersion: tt.maxVersion})
+
+			// the InformResponse keeps the namespace of the Inform
+			resp := cpe.postExpect(tt.inform, http.StatusOK, "InformResponse", "cwmp-1-4")
+			if tt.use != "" && !strings.Contains(resp, ">"+tt.use+"</") {
+				t.Fatalf("response without UseCWMPVersion %v: %s", tt.use, resp)
+			}
+			if tt.use == "" && strings.Contains(resp, "UseCWMPVersion") {
+				t.Fatalf("unexpected UseCWMPVersion: %s", resp)
+			}
+			cpe.postExpect("", http.StatusOK, "Reboot", tt.namespace)
+		})
+	}
+}
+
+// getTestEnvelopes splits a response into its envelopes.
+func getTestEnvelopes(t *testing.T, resp string) []string {
+	t.Helper()
+	chunks, err := proto.SplitEnvelopes([]byte(resp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := []string{}
+	for _, v := range chunks {
+		out = append(out, string(v))
+	}
+	return out
+}
+
+func TestHandlePostEnvelopesInOrder(t *testing.T) {
+	h := &testHandler{device: &testDevice{}}
+	_, cpe := newTestACS(t, h, Options{MaxEnvelopes: 2})
+
+	body := testEnvelope("1", "", testInform("SN1", 1)) + "\n" + testEnvelope("2", "", testTransferComplete)
+	envelopes := getTestEnvelopes(t, cpe.postExpect(body, http.StatusOK))
+	if len(envelopes) != 2 {
+		t.Fatalf("%v envelopes, want 2", len(envelopes))
+	}
+	for i, want := range []string{"InformResponse", "TransferCompleteResponse"} {
+		if !strings.Contains(envelopes[i], want) || !strings.Contains(envelopes[i], fmt.Sprintf(">%d</", i+1)) {
+			t.Fatalf("envelope %v is not the %v of ID %v: %s", i, want, i+1, envelopes[i])
+		}
+	}
+	if got, want := h.getHandled(), []string{"Inform", "TransferComplete"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("handled %v, want %v", got, want)
+	}
+}
+
+func TestHandlePostMaxEnvelopes(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxEnvelopes int
+		envelopes    int
+		fault        bool
+	}{
+		{"default limit", 0, 2, true},
+		{"above limit", 2, 3, true},
+		{"at limit", 2, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &testHandler{device: &testDevice{}}
+			_, cpe := newTestACS(t, h, Options{MaxEnvelopes: tt.maxEnvelopes})
+			body := testEnvelope("1", "", testInform("SN1", 1))
+			for i := 1; i < tt.envelopes; i++ {
+				body += testEnvelope(fmt.Sprint(i+1), "", testTransferComplete)
+			}
+			resp := cpe.postExpect(body, http.StatusOK)
+			if !tt.fault {
+				if len(getTestEnvelopes(t, resp)) != tt.envelopes {
+					t.Fatalf("not every envelope answered: %s", resp)
+				}
+				return
+			}
+			// nothing of a POST above the limit is processed
+			if !strings.Contains(resp, "<faultcode>8003</faultcode>") || len(getTestEnvelopes(t, resp)) != 1 {
+				t.Fatalf("response is not a single fault 8003: %s", resp)
+			}
+			if got := h.getHandled(); len(got) != 0 {
+				t.Fatalf("handled %v", got)
+			}
+		})
+	}
+}
+
+func TestHandlePostSendsUpToCPEMaxEnvelopes(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxEnvelopes int
+		batches      []int
+	}{
+		{"one", 1, []int{1, 1, 1}},
+		{"two", 2, []int{2, 1}},
+		{"more than queued", 5, []int{3}},
+		{"zero", 0, []int{1, 1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &testHandler{device: &testDevice{calls: []*testMethodCall{
+				{name: "Reboot", commandKey: "r1"},
+				{name: "Reboot", commandKey: "r2"},
+				{name: "Reboot", commandKey: "r3"},
+			}}}
+			// the ACS accepts the batched responses
+			_, cpe := newTestACS(t, h, Options{MaxEnvelopes: 5})
+			cpe.postExpect(testEnvelope("1", "", testInform("SN1", tt.maxEnvelopes)), http.StatusOK, "InformResponse")
+
+			body := ""
+			for _, n := range tt.batches {
+				envelopes := getTestEnvelopes(t, cpe.postExpect(body, http.StatusOK, "Reboot"))
+				if len(envelopes) != n {
+					t.Fatalf("%v envelopes, want %v", len(envelopes), n)
+				}
+				body = strings.Repeat(testEnvelope("r", "", `<cwmp:RebootResponse/>`), n)
+			}
+		})
+	}
+}
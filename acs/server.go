@@ -2,20 +2,26 @@ package acs
 
 import (
 	"crypto/subtle"
+	"crypto/x509"
+	"sync"
 	"time"
 
 	"github.com/gorilla/sessions"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
 type AuthType string
 
 const (
-	AuthTypeNone  AuthType = "None"
-	AuthTypeBasic AuthType = "Basic"
+	AuthTypeNone   AuthType = "None"
+	AuthTypeBasic  AuthType = "Basic"
+	AuthTypeDigest AuthType = "Digest"
+	// AuthTypeClientCert authenticates CPEs with their TLS client certificate.
+	AuthTypeClientCert AuthType = "ClientCert"
 )
 
 type Options struct {
@@ -23,12 +29,37 @@ type Options struct {
 	AuthUsername string
 	AuthPassword string
 	DumpBody     bool
+
+	// CredentialsProvider resolves per device credentials, instead of
+	// AuthUsername and AuthPassword.
+	CredentialsProvider CredentialsProvider
+	// ClientCAs verifies the client certificates of AuthTypeClientCert.
+	ClientCAs *x509.CertPool
+
+	// MaxCWMPVersion is the highest CWMP version negotiated with CPEs, 1.4 if
+	// empty. It also caps the version of an Inform without SupportedCWMPVersions.
+	MaxCWMPVersion string
+	// HoldRequests stops CPE requests while the device has queued method calls.
+	HoldRequests bool
+	// MaxEnvelopes is the number of envelopes the ACS accepts in one POST, 1 if zero.
+	MaxEnvelopes int
+	// SessionTracking relates the POSTs of a session, SessionTrackingCookie if empty.
+	SessionTracking SessionTracking
+	// SessionTimeout ends sessions idle for longer, 30s if zero. The
+	// SessionTimeout header of the CPE takes precedence.
+	SessionTimeout time.Duration
 }
 type AcsServer struct {
 	logger              *zap.Logger
 	dataRetentionPeriod time.Duration
 	uploadBucket        string
 	handler             AcsHanlder
+	options             Options
+
+	sessionMap      map[string]*Session
+	sessionMapMutex sync.Mutex
+	closeCh         chan struct{}
+	closeOnce       sync.Once
 }
 
 func NewAcsServer(handler AcsHanlder, dataRetentionPeriod time.Duration) *AcsServer {
@@ -37,10 +68,20 @@ func NewAcsServer(handler AcsHanlder, dataRetentionPeriod time.Duration) *AcsSer
 		handler:             handler,
 		uploadBucket:        "acs-upload",
 		dataRetentionPeriod: dataRetentionPeriod,
+		sessionMap:          map[string]*Session{},
+		closeCh:             make(chan struct{}),
 	}
+	go s.runSessionExpiry()
 	return &s
 }
 
+// Close stops the expiry of idle sessions.
+func (s *AcsServer) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+	})
+}
+
 func (s *AcsServer) SetupPostEchoGroup(group *echo.Group, sessionStore sessions.Store) *echo.Group {
 	return s.SetupPostEchoGroupWithOptions(group, sessionStore, Options{
 		AuthType: AuthTypeNone,
@@ -49,6 +90,7 @@ func (s *AcsServer) SetupPostEchoGroup(group *echo.Group, sessionStore sessions.
 }
 
 func (s *AcsServer) SetupPostEchoGroupWithOptions(group *echo.Group, sessionStore sessions.Store, opts Options) *echo.Group {
+	s.options = opts
 	if opts.DumpBody {
 		group.Use(middleware.BodyDump(func(c echo.Context, reqBody, resBody []byte) {
 			limit := 1000
@@ -67,19 +109,66 @@ func (s *AcsServer) SetupPostEchoGroupWithOptions(group *echo.Group, sessionStor
 
 	if opts.AuthType == AuthTypeBasic {
 		group.Use(middleware.BasicAuth(func(username, password string, c echo.Context) (bool, error) {
-			if subtle.ConstantTimeCompare([]byte(username), []byte(opts.AuthUsername)) == 1 &&
-				subtle.ConstantTimeCompare([]byte(password), []byte(opts.AuthPassword)) == 1 {
+			expected, ok, err := s.getCredentials(username, c)
+			if err != nil || !ok {
+				return false, err
+			}
+			if subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1 {
+				c.Set(authUsernameKey, username)
 				return true, nil
 			}
 			return false, nil
 		}))
 	}
+	if opts.AuthType == AuthTypeDigest {
+		group.Use(DigestAuth(digestRealm, s.getCredentials))
+	}
+	if opts.AuthType == AuthTypeClientCert {
+		group.Use(ClientCertAuth(opts.ClientCAs))
+	}
 
+	switch opts.SessionTracking {
+	case SessionTrackingConnection, SessionTrackingClientIP, SessionTrackingURLToken:
+		sessionStore = newTrackingStore(opts.SessionTracking)
+	}
+	if opts.SessionTracking == SessionTrackingClientIP {
+		perDevice := opts.AuthType == AuthTypeClientCert ||
+			(opts.AuthType == AuthTypeBasic || opts.AuthType == AuthTypeDigest) && opts.CredentialsProvider != nil
+		if !perDevice {
+			s.logger.Warn("CPEs behind one NAT share sessions with client IP tracking and shared credentials")
+		}
+		group.Use(withAuthUsername)
+	}
+	if opts.SessionTracking == SessionTrackingConnection {
+		group.Use(s.requireConnID)
+	}
 	group.Use(session.Middleware(sessionStore))
 	group.POST("", s.HandlePost)
+	if opts.SessionTracking == SessionTrackingURLToken {
+		group.POST(sessionTokenPath+":token", s.HandlePost)
+	}
 	return group
 }
 
+// authUsernameKey is the echo context key of the authenticated username.
+const authUsernameKey = "AuthUsername"
+
+// getCredentials returns the password of username from the
+// CredentialsProvider, or the single AuthUsername and AuthPassword.
+func (s *AcsServer) getCredentials(username string, c echo.Context) (string, bool, error) {
+	if p := s.options.CredentialsProvider; p != nil {
+		password, ok, err := p.GetCredentials(c.Request().Context(), username)
+		if err != nil {
+			return "", false, errors.Wrap(err, "get credentials")
+		}
+		return password, ok, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(username), []byte(s.options.AuthUsername)) == 1 {
+		return s.options.AuthPassword, true, nil
+	}
+	return "", false, nil
+}
+
 func (s *AcsServer) SetupUploadEchoGroup(group *echo.Group) *echo.Group {
 	group.POST("/:name", s.HandleUpload)
 	group.PUT("/:name", s.HandleUpload)
@@ -0,0 +1,332 @@
+package acs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/spf13/cast"
+	"go.uber.org/zap"
+)
+
+// SessionState is the progress of a CWMP session.
+type SessionState string
+
+const (
+	SessionStateNew            SessionState = "New"
+	SessionStateInformReceived SessionState = "InformReceived"
+	SessionStateCPERequests    SessionState = "CPERequests"
+	SessionStateEmptyPost      SessionState = "EmptyPost"
+	SessionStateACSRequests    SessionState = "ACSRequests"
+	// SessionStateACSDone follows the empty response of the ACS, the CPE may
+	// still send the requests it held back.
+	SessionStateACSDone SessionState = "ACSDone"
+	SessionStateClosing SessionState = "Closing"
+)
+
+// SessionEvent moves a session from one state to the next.
+type SessionEvent string
+
+const (
+	SessionEventInform      SessionEvent = "Inform"
+	SessionEventCPERequest  SessionEvent = "CPERequest"
+	SessionEventCPEResponse SessionEvent = "CPEResponse"
+	SessionEventEmptyPost   SessionEvent = "EmptyPost"
+	SessionEventACSRequest  SessionEvent = "ACSRequest"
+	SessionEventACSDone     SessionEvent = "ACSDone"
+	SessionEventClose       SessionEvent = "Close"
+)
+
+// sessionTransitions lists the events allowed in each state. Closing is
+// final, the next Inform starts a new session. The session closes when the
+// ACS answers an empty POST with an empty response, or when it idles out.
+var sessionTransitions = map[SessionState]map[SessionEvent]SessionState{
+	SessionStateNew: {
+		SessionEventInform: SessionStateInformReceived,
+		SessionEventClose:  SessionStateClosing,
+	},
+	SessionStateInformReceived: {
+		SessionEventCPERequest: SessionStateCPERequests,
+		SessionEventEmptyPost:  SessionStateEmptyPost,
+		SessionEventClose:      SessionStateClosing,
+	},
+	SessionStateCPERequests: {
+		SessionEventCPERequest: SessionStateCPERequests,
+		SessionEventEmptyPost:  SessionStateEmptyPost,
+		SessionEventClose:      SessionStateClosing,
+	},
+	SessionStateEmptyPost: {
+		SessionEventACSRequest: SessionStateACSRequests,
+		SessionEventClose:      SessionStateClosing,
+	},
+	SessionStateACSRequests: {
+		SessionEventACSRequest:  SessionStateACSRequests,
+		SessionEventCPEResponse: SessionStateACSRequests,
+		SessionEventCPERequest:  SessionStateACSRequests,
+		SessionEventACSDone:     SessionStateACSDone,
+		SessionEventClose:       SessionStateClosing,
+	},
+	SessionStateACSDone: {
+		SessionEventCPERequest: SessionStateACSDone,
+		SessionEventEmptyPost:  SessionStateEmptyPost,
+		SessionEventClose:      SessionStateClosing,
+	},
+}
+
+// sessionExpiryInterval is how often idle sessions are ended.
+const sessionExpiryInterval = time.Second
+
+// Session tracks the state of one CWMP session. The device and timeout are
+// set by the first Inform, read them with GetDevice and GetTimeout.
+type Session struct {
+	ID string
+
+	mutex        sync.Mutex
+	oui          string
+	productClass string
+	serialNumber string
+	timeout      time.Duration
+	state        SessionState
+	updated      time.Time
+}
+
+func newSession() *Session {
+	return &Session{
+		ID:      newSessionID(),
+		state:   SessionStateNew,
+		updated: time.Now(),
+	}
+}
+
+func newSessionID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return cast.ToString(time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+func (s *Session) GetState() SessionState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.state
+}
+
+func (s *Session) GetUpdated() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.updated
+}
+
+func (s *Session) isExpired(now time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.timeout > 0 && now.Sub(s.updated) > s.timeout
+}
+
+func (s *Session) isDevice(oui string, productClass string, serialNumber string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.oui == oui && s.productClass == productClass && s.serialNumber == serialNumber
+}
+
+// GetDevice returns the identity of the device of the session.
+func (s *Session) GetDevice() (oui string, productClass string, serialNumber string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.oui, s.productClass, s.serialNumber
+}
+
+// GetTimeout returns the idle time after which the session ends.
+func (s *Session) GetTimeout() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.timeout
+}
+
+// setDevice records the device and idle timeout of the Inform.
+func (s *Session) setDevice(oui string, productClass string, serialNumber string, timeout time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.oui = oui
+	s.productClass = productClass
+	s.serialNumber = serialNumber
+	s.timeout = timeout
+}
+
+// Transit applies event and returns the previous state, it fails if event is
+// not allowed in the current state.
+func (s *Session) Transit(event SessionEvent) (SessionState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	from := s.state
+	to, ok := sessionTransitions[from][event]
+	if !ok {
+		return from, errors.Errorf("%v not allowed in session state %v", event, from)
+	}
+	s.state = to
+	s.updated = time.Now()
+	return from, nil
+}
+
+// ActiveSessions returns the sessions that have not ended.
+func (s *AcsServer) ActiveSessions() []*Session {
+	now := time.Now()
+	s.sessionMapMutex.Lock()
+	defer s.sessionMapMutex.Unlock()
+	out := []*Session{}
+	for _, v := range s.sessionMap {
+		if !v.isExpired(now) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// IsDeviceInSession reports whether the device has a session that has not
+// ended.
+func (s *AcsServer) IsDeviceInSession(oui string, productClass string, serialNumber string) bool {
+	for _, v := range s.ActiveSessions() {
+		if v.isDevice(oui, productClass, serialNumber) {
+			return true
+		}
+	}
+	return false
+}
+
+// getSessionTimeout returns the idle timeout of sessions whose CPE sends no
+// SessionTimeout.
+func (s *AcsServer) getSessionTimeout() time.Duration {
+	if s.options.SessionTimeout <= 0 {
+		return 30 * time.Second
+	}
+	return s.options.SessionTimeout
+}
+
+// runSessionExpiry ends idle sessions every sessionExpiryInterval until the
+// server is closed.
+func (s *AcsServer) runSessionExpiry() {
+	ticker := time.NewTicker(sessionExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case <-ticker.C:
+			s.expireSessions()
+		}
+	}
+}
+
+// expireSessions ends the sessions idle for longer than their timeout.
+func (s *AcsServer) expireSessions() {
+	now := time.Now()
+	expired := []*Session{}
+	s.sessionMapMutex.Lock()
+	for _, v := range s.sessionMap {
+		if v.isExpired(now) {
+			expired = append(expired, v)
+		}
+	}
+	s.sessionMapMutex.Unlock()
+	for _, v := range expired {
+		s.logger.Debug("session expired", zap.String("session", v.ID))
+		s.closeSession(context.Background(), v)
+	}
+}
+
+// closeDeviceSessions ends the other sessions of the device of session, a
+// device has one session at a time.
+func (s *AcsServer) closeDeviceSessions(ctx context.Context, session *Session) {
+	oui, productClass, serialNumber := session.GetDevice()
+	others := []*Session{}
+	s.sessionMapMutex.Lock()
+	for _, v := range s.sessionMap {
+		if v != session && v.isDevice(oui, productClass, serialNumber) {
+			others = append(others, v)
+		}
+	}
+	s.sessionMapMutex.Unlock()
+	for _, v := range others {
+		s.logger.Debug("session replaced", zap.String("session", v.ID))
+		s.closeSession(ctx, v)
+	}
+}
+
+// getSession returns the session of the cookie, or a new one if the cookie
+// has none or its session has ended.
+func (s *AcsServer) getSession(sess *sessions.Session) *Session {
+	id := cast.ToString(sess.Values["SessionID"])
+	s.sessionMapMutex.Lock()
+	v, ok := s.sessionMap[id]
+	s.sessionMapMutex.Unlock()
+	if !ok {
+		return newSession()
+	}
+	// the expiry ticker may not have run yet
+	if v.isExpired(time.Now()) {
+		s.logger.Debug("session expired", zap.String("session", v.ID))
+		s.closeSession(context.Background(), v)
+		return newSession()
+	}
+	return v
+}
+
+// transitSession applies event to session, notifies the handler and keeps
+// the registry of open sessions up to date.
+func (s *AcsServer) transitSession(ctx context.Context, session *Session, event SessionEvent) error {
+	from, err := session.Transit(event)
+	if err != nil {
+		s.logger.Warn("illegal session transition",
+			zap.String("session", session.ID),
+			zap.String("event", string(event)),
+			zap.String("state", string(from)),
+		)
+		return err
+	}
+	to := session.GetState()
+
+	s.sessionMapMutex.Lock()
+	if to == SessionStateClosing {
+		delete(s.sessionMap, session.ID)
+	} else {
+		s.sessionMap[session.ID] = session
+	}
+	s.sessionMapMutex.Unlock()
+
+	s.logger.Debug("session transition",
+		zap.String("session", session.ID),
+		zap.String("event", string(event)),
+		zap.String("from", string(from)),
+		zap.String("to", string(to)),
+	)
+	s.handler.HandleSessionTransition(ctx, session, event, from, to)
+	return nil
+}
+
+// closeSession ends session, unless it is already closing.
+func (s *AcsServer) closeSession(ctx context.Context, session *Session) {
+	if session.GetState() == SessionStateClosing {
+		return
+	}
+	s.transitSession(ctx, session, SessionEventClose)
+}
+
+// endSession closes session on the final empty response and drops the stored
+// session values.
+func (s *AcsServer) endSession(c echo.Context, sess *sessions.Session, session *Session) {
+	s.closeSession(c.Request().Context(), session)
+	if sess.IsNew {
+		return
+	}
+	sess.Options = &sessions.Options{
+		Path:   "/acs",
+		MaxAge: -1,
+	}
+	sess.Save(c.Request(), c.Response())
+}
@@ -0,0 +1,62 @@
+package acs
+
+import (
+	"testing"
+)
+
+func TestSessionTransit(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []SessionEvent
+		state  SessionState
+		fail   bool
+	}{
+		{"inform", []SessionEvent{SessionEventInform}, SessionStateInformReceived, false},
+		{"cpe requests", []SessionEvent{SessionEventInform, SessionEventCPERequest, SessionEventCPERequest}, SessionStateCPERequests, false},
+		{"empty post", []SessionEvent{SessionEventInform, SessionEventEmptyPost}, SessionStateEmptyPost, false},
+		{"acs requests", []SessionEvent{SessionEventInform, SessionEventEmptyPost, SessionEventACSRequest, SessionEventCPEResponse, SessionEventACSRequest}, SessionStateACSRequests, false},
+		{"released cpe request", []SessionEvent{SessionEventInform, SessionEventEmptyPost, SessionEventACSRequest, SessionEventCPERequest}, SessionStateACSRequests, false},
+		{"close", []SessionEvent{SessionEventInform, SessionEventEmptyPost, SessionEventClose}, SessionStateClosing, false},
+		{"acs done", []SessionEvent{SessionEventInform, SessionEventEmptyPost, SessionEventACSRequest, SessionEventCPEResponse, SessionEventACSDone}, SessionStateACSDone, false},
+		{"held request after acs done", []SessionEvent{SessionEventInform, SessionEventEmptyPost, SessionEventACSRequest, SessionEventACSDone, SessionEventCPERequest, SessionEventCPERequest}, SessionStateACSDone, false},
+		{"empty post after acs done", []SessionEvent{SessionEventInform, SessionEventEmptyPost, SessionEventACSRequest, SessionEventACSDone, SessionEventEmptyPost, SessionEventClose}, SessionStateClosing, false},
+		{"close new", []SessionEvent{SessionEventClose}, SessionStateClosing, false},
+		{"request before inform", []SessionEvent{SessionEventCPERequest}, SessionStateNew, true},
+		{"empty post before inform", []SessionEvent{SessionEventEmptyPost}, SessionStateNew, true},
+		{"second inform", []SessionEvent{SessionEventInform, SessionEventInform}, SessionStateInformReceived, true},
+		{"response before acs request", []SessionEvent{SessionEventInform, SessionEventCPEResponse}, SessionStateInformReceived, true},
+		{"acs request before empty post", []SessionEvent{SessionEventInform, SessionEventACSRequest}, SessionStateInformReceived, true},
+		{"request after empty post", []SessionEvent{SessionEventInform, SessionEventEmptyPost, SessionEventCPERequest}, SessionStateEmptyPost, true},
+		{"response after acs done", []SessionEvent{SessionEventInform, SessionEventEmptyPost, SessionEventACSRequest, SessionEventACSDone, SessionEventCPEResponse}, SessionStateACSDone, true},
+		{"inform after close", []SessionEvent{SessionEventClose, SessionEventInform}, SessionStateClosing, true},
+		{"close after close", []SessionEvent{SessionEventClose, SessionEventClose}, SessionStateClosing, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newSession()
+			var err error
+			for _, event := range tt.events {
+				if _, err = session.Transit(event); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.fail {
+				t.Fatalf("error %v, want failure %v", err, tt.fail)
+			}
+			if state := session.GetState(); state != tt.state {
+				t.Fatalf("state %v, want %v", state, tt.state)
+			}
+		})
+	}
+}
+
+func TestSessionTransitReturnsPreviousState(t *testing.T) {
+	session := newSession()
+	from, err := session.Transit(SessionEventInform)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != SessionStateNew {
+		t.Fatalf("from %v, want %v", from, SessionStateNew)
+	}
+}
@@ -0,0 +1,192 @@
+package acs
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/cast"
+	"go.uber.org/zap"
+)
+
+// SessionTracking selects how the POSTs of one CWMP session are related to
+// each other.
+type SessionTracking string
+
+const (
+	// SessionTrackingCookie uses the session cookie, the default.
+	SessionTrackingCookie SessionTracking = "Cookie"
+	// SessionTrackingConnection uses the keep-alive connection of the
+	// session. The http.Server has to set ConnContext to ConnContext,
+	// requests without it are refused.
+	SessionTrackingConnection SessionTracking = "Connection"
+	// SessionTrackingClientIP uses the client IP and the authenticated
+	// username, for CPEs that open a new connection per POST. Without
+	// per device credentials, CPEs behind one NAT share a session and may be
+	// sent each other's requests.
+	SessionTrackingClientIP SessionTracking = "ClientIP"
+	// SessionTrackingURLToken redirects the Inform to a URL carrying a
+	// session token, which the CPE uses for the rest of the session.
+	SessionTrackingURLToken SessionTracking = "URLToken"
+)
+
+// sessionTokenPath is the path, below the ACS URL, of the session URLs handed
+// out by SessionTrackingURLToken.
+const sessionTokenPath = "/session/"
+
+type connIDContextKey struct{}
+
+type authUsernameContextKey struct{}
+
+var connIDCounter atomic.Uint64
+
+// ConnContext gives every connection of an http.Server an ID, it is needed
+// by SessionTrackingConnection.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connIDContextKey{}, connIDCounter.Add(1))
+}
+
+// requireConnID returns a middleware that refuses requests without the
+// connection ID of ConnContext, their session values would never be saved.
+func (s *AcsServer) requireConnID(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if _, ok := c.Request().Context().Value(connIDContextKey{}).(uint64); !ok {
+			s.logger.Error("connection session tracking needs the ConnContext of the http.Server", zap.String("remote", c.Request().RemoteAddr))
+			return echo.NewHTTPError(http.StatusInternalServerError, "no connection id")
+		}
+		return next(c)
+	}
+}
+
+// withAuthUsername returns a middleware that passes the authenticated
+// username to the tracking store in the request context.
+func withAuthUsername(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if username := cast.ToString(c.Get(authUsernameKey)); username != "" {
+			r := c.Request()
+			c.SetRequest(r.WithContext(context.WithValue(r.Context(), authUsernameContextKey{}, username)))
+		}
+		return next(c)
+	}
+}
+
+type trackedValues struct {
+	values  map[interface{}]interface{}
+	expires time.Time
+}
+
+// trackingStore is a sessions.Store that keeps session values in memory,
+// keyed by the client address or the URL token instead of a cookie.
+type trackingStore struct {
+	tracking SessionTracking
+	mutex    sync.Mutex
+	items    map[string]*trackedValues
+}
+
+func newTrackingStore(tracking SessionTracking) *trackingStore {
+	return &trackingStore{
+		tracking: tracking,
+		items:    map[string]*trackedValues{},
+	}
+}
+
+func (s *trackingStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *trackingStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	sess := sessions.NewSession(s, name)
+	sess.Options = &sessions.Options{
+		Path:   "/",
+		MaxAge: 1800,
+	}
+	sess.IsNew = true
+	key := s.getKey(r)
+	if key == "" {
+		return sess, nil
+	}
+	sess.ID = key
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expire()
+	if item, ok := s.items[key]; ok {
+		for k, v := range item.values {
+			sess.Values[k] = v
+		}
+		sess.IsNew = false
+	}
+	return sess, nil
+}
+
+func (s *trackingStore) Save(r *http.Request, w http.ResponseWriter, sess *sessions.Session) error {
+	key := s.getKey(r)
+	if key == "" {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if sess.Options != nil && sess.Options.MaxAge < 0 {
+		delete(s.items, key)
+		return nil
+	}
+	maxAge := 1800
+	if sess.Options != nil && sess.Options.MaxAge > 0 {
+		maxAge = sess.Options.MaxAge
+	}
+	values := map[interface{}]interface{}{}
+	for k, v := range sess.Values {
+		values[k] = v
+	}
+	s.items[key] = &trackedValues{
+		values:  values,
+		expires: time.Now().Add(time.Duration(maxAge) * time.Second),
+	}
+	return nil
+}
+
+func (s *trackingStore) expire() {
+	now := time.Now()
+	for k, v := range s.items {
+		if now.After(v.expires) {
+			delete(s.items, k)
+		}
+	}
+}
+
+func (s *trackingStore) getKey(r *http.Request) string {
+	switch s.tracking {
+	case SessionTrackingConnection:
+		if id, ok := r.Context().Value(connIDContextKey{}).(uint64); ok {
+			return strconv.FormatUint(id, 10)
+		}
+		return ""
+	case SessionTrackingClientIP:
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		username, _ := r.Context().Value(authUsernameContextKey{}).(string)
+		return host + " " + username
+	case SessionTrackingURLToken:
+		return getSessionToken(r)
+	}
+	return ""
+}
+
+// getSessionToken returns the token of a session URL, or an empty string.
+func getSessionToken(r *http.Request) string {
+	i := strings.LastIndex(r.URL.Path, sessionTokenPath)
+	if i < 0 {
+		return ""
+	}
+	return strings.Trim(r.URL.Path[i+len(sessionTokenPath):], "/")
+}
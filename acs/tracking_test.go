@@ -0,0 +1,165 @@
+package acs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netdoop/cwmp/proto"
+)
+
+type testCredentials map[string]string
+
+func (c testCredentials) GetCredentials(ctx context.Context, username string) (string, bool, error) {
+	password, ok := c[username]
+	return password, ok, nil
+}
+
+func (c testCredentials) CheckDevice(ctx context.Context, username string, deviceID *proto.DeviceID) error {
+	return nil
+}
+
+func newTestTrackingHandler() *testHandler {
+	return &testHandler{device: &testDevice{calls: []*testMethodCall{{name: "Reboot", commandKey: "reboot"}}}}
+}
+
+func TestSessionTrackingConnection(t *testing.T) {
+	_, e := newTestACSHandler(t, newTestTrackingHandler(), Options{SessionTracking: SessionTrackingConnection})
+	srv := httptest.NewUnstartedServer(e)
+	srv.Config.ConnContext = ConnContext
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	// without cookies, the keep-alive connection relates the POSTs
+	cpe := &testCPE{t: t, client: &http.Client{Transport: &http.Transport{}}, url: srv.URL + "/acs"}
+	other := &testCPE{t: t, client: &http.Client{Transport: &http.Transport{}}, url: srv.URL + "/acs"}
+	cpe.postExpect(testEnvelope("1", "", testInform("SN1", 1)), http.StatusOK, "InformResponse")
+	other.postExpect("", http.StatusNoContent)
+	cpe.postExpect("", http.StatusOK, "Reboot")
+}
+
+func TestSessionTrackingConnectionWithoutConnContext(t *testing.T) {
+	h := newTestTrackingHandler()
+	_, e := newTestACSHandler(t, h, Options{SessionTracking: SessionTrackingConnection})
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+
+	cpe := &testCPE{t: t, client: &http.Client{}, url: srv.URL + "/acs"}
+	cpe.postExpect(testEnvelope("1", "", testInform("SN1", 1)), http.StatusInternalServerError)
+	if got := h.getHandled(); len(got) != 0 {
+		t.Fatalf("handled %v", got)
+	}
+}
+
+func TestSessionTrackingClientIP(t *testing.T) {
+	opts := Options{
+		AuthType:            AuthTypeBasic,
+		CredentialsProvider: testCredentials{"cpe1": "secret1", "cpe2": "secret2"},
+		SessionTracking:     SessionTrackingClientIP,
+	}
+	_, e := newTestACSHandler(t, newTestTrackingHandler(), opts)
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+
+	// a new connection per POST, the client IP and the username relate them
+	newCPE := func(username string, password string) *testCPE {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		return &testCPE{t: t, client: client, url: srv.URL + "/acs", username: username, password: password}
+	}
+	cpe1 := newCPE("cpe1", "secret1")
+	cpe2 := newCPE("cpe2", "secret2")
+	cpe1.postExpect(testEnvelope("1", "", testInform("SN1", 1)), http.StatusOK, "InformResponse")
+	cpe2.postExpect("", http.StatusNoContent)
+	cpe1.postExpect("", http.StatusOK, "Reboot")
+}
+
+func TestSessionTrackingURLToken(t *testing.T) {
+	_, e := newTestACSHandler(t, newTestTrackingHandler(), Options{SessionTracking: SessionTrackingURLToken})
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	// the Inform is redirected to a session URL
+	inform := testEnvelope("1", "", testInform("SN1", 1))
+	resp, err := client.Post(srv.URL+"/acs", "text/xml", strings.NewReader(inform))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusTemporaryRedirect || !strings.HasPrefix(location, srv.URL+"/acs"+sessionTokenPath) {
+		t.Fatalf("status %v location %q", resp.StatusCode, location)
+	}
+
+	cpe := &testCPE{t: t, client: client, url: location}
+	other := &testCPE{t: t, client: client, url: srv.URL + "/acs" + sessionTokenPath + newSessionID()}
+	cpe.postExpect(inform, http.StatusOK, "InformResponse")
+	other.postExpect("", http.StatusNoContent)
+	cpe.postExpect("", http.StatusOK, "Reboot")
+}
+
+func TestTrackingStore(t *testing.T) {
+	store := newTrackingStore(SessionTrackingURLToken)
+	r := httptest.NewRequest(http.MethodPost, "/acs"+sessionTokenPath+"t1", nil)
+
+	sess, _ := store.New(r, "session")
+	if !sess.IsNew || sess.ID != "t1" {
+		t.Fatalf("new %v id %q", sess.IsNew, sess.ID)
+	}
+	sess.Values["SerialNumber"] = "SN1"
+	if err := store.Save(r, nil, sess); err != nil {
+		t.Fatal(err)
+	}
+	sess, _ = store.New(r, "session")
+	if sess.IsNew || sess.Values["SerialNumber"] != "SN1" {
+		t.Fatalf("saved values lost: new %v values %v", sess.IsNew, sess.Values)
+	}
+
+	// MaxAge < 0 drops the values
+	sess.Options.MaxAge = -1
+	store.Save(r, nil, sess)
+	if sess, _ = store.New(r, "session"); !sess.IsNew {
+		t.Fatal("values kept after MaxAge -1")
+	}
+
+	// expired values are dropped
+	store.items["t1"] = &trackedValues{values: map[interface{}]interface{}{"SerialNumber": "SN1"}, expires: time.Now().Add(-time.Second)}
+	if sess, _ = store.New(r, "session"); !sess.IsNew {
+		t.Fatal("expired values kept")
+	}
+
+	// without a key nothing is saved
+	r2 := httptest.NewRequest(http.MethodPost, "/acs", nil)
+	sess, _ = store.New(r2, "session")
+	sess.Values["SerialNumber"] = "SN1"
+	store.Save(r2, nil, sess)
+	if len(store.items) != 0 {
+		t.Fatalf("saved without a key: %v", store.items)
+	}
+}
+
+func TestGetSessionToken(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/acs", ""},
+		{"/acs/session/abc", "abc"},
+		{"/acs/session/abc/", "abc"},
+		{"/cwmp/acs/session/abc", "abc"},
+		{"/acs/session/", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, tt.path, nil)
+		if got := getSessionToken(r); got != tt.want {
+			t.Errorf("getSessionToken(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,499 @@
+package acs
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	xmppNSClient  = "jabber:client"
+	xmppNSStream  = "http://etherx.jabber.org/streams"
+	xmppNSTLS     = "urn:ietf:params:xml:ns:xmpp-tls"
+	xmppNSSASL    = "urn:ietf:params:xml:ns:xmpp-sasl"
+	xmppNSBind    = "urn:ietf:params:xml:ns:xmpp-bind"
+	xmppNSSession = "urn:ietf:params:xml:ns:xmpp-session"
+	xmppNSStanzas = "urn:ietf:params:xml:ns:xmpp-stanzas"
+	xmppNSPing    = "urn:xmpp:ping"
+
+	// XMPPConnReqNamespace is the namespace of the TR-069 Annex K connection request.
+	XMPPConnReqNamespace = "urn:broadband-forum-org:cwmp:xmppConnReq-1-0"
+)
+
+type XMPPOptions struct {
+	// Addr is the "host:port" of the server, "<Domain>:5222" if empty.
+	Addr     string
+	Domain   string
+	Username string
+	Password string
+	// Resource is the resource of the ACS JID, "acs" if empty.
+	Resource string
+	// TLSConfig enables STARTTLS, which the server then has to offer.
+	TLSConfig *tls.Config
+	// AllowInsecure allows SASL PLAIN without TLS, which sends the
+	// credentials in cleartext. Annex K requires TLS.
+	AllowInsecure bool
+	// Timeout bounds connecting, each write and each connection request,
+	// 10s if zero.
+	Timeout time.Duration
+	// KeepAlive is the interval of whitespace keepalives, 60s if zero.
+	KeepAlive time.Duration
+}
+
+// XMPPClient keeps an XMPP session of the ACS, over which it sends TR-069
+// Annex K connection requests to the JIDs of CPEs.
+type XMPPClient struct {
+	logger *zap.Logger
+	opts   XMPPOptions
+
+	mutex   sync.Mutex
+	conn    net.Conn
+	jid     string
+	done    chan struct{}
+	nextID  int
+	pending map[string]chan *xmppElement
+}
+
+// xmppElement is a generic XML element of the stream.
+type xmppElement struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr    `xml:",any,attr"`
+	Text     string        `xml:",chardata"`
+	Children []xmppElement `xml:",any"`
+}
+
+func (e *xmppElement) attr(name string) string {
+	for _, v := range e.Attrs {
+		if v.Name.Local == name {
+			return v.Value
+		}
+	}
+	return ""
+}
+
+func (e *xmppElement) child(name string) *xmppElement {
+	for i := range e.Children {
+		if e.Children[i].XMLName.Local == name {
+			return &e.Children[i]
+		}
+	}
+	return nil
+}
+
+func NewXMPPClient(opts XMPPOptions) *XMPPClient {
+	if opts.Addr == "" {
+		opts.Addr = net.JoinHostPort(opts.Domain, "5222")
+	}
+	if opts.Resource == "" {
+		opts.Resource = "acs"
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.KeepAlive <= 0 {
+		opts.KeepAlive = 60 * time.Second
+	}
+	return &XMPPClient{
+		logger:  zap.L().Named("xmpp"),
+		opts:    opts,
+		pending: map[string]chan *xmppElement{},
+	}
+}
+
+// JID returns the full JID bound to the session, empty if not connected.
+func (c *XMPPClient) JID() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.jid
+}
+
+// Connect opens the XMPP session, unless it is open.
+func (c *XMPPClient) Connect(ctx context.Context) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.connect(ctx)
+}
+
+// Close ends the XMPP session.
+func (c *XMPPClient) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	// best effort, the connection is dropped anyway
+	c.write(c.conn, "</stream:stream>")
+	c.disconnect(errors.New("closed"))
+	return nil
+}
+
+// SendConnectionRequest asks the CPE at jid to open a session, it succeeds
+// when the CPE answers the IQ with a result.
+func (c *XMPPClient) SendConnectionRequest(ctx context.Context, jid string, username string, password string) (*ConnectionRequestResult, error) {
+	result := &ConnectionRequestResult{}
+	if jid == "" {
+		result.Skipped, result.SkipReason = true, "empty jid"
+		return result, nil
+	}
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+
+	c.mutex.Lock()
+	if err := c.connect(ctx); err != nil {
+		c.mutex.Unlock()
+		return result, err
+	}
+	c.nextID++
+	id := fmt.Sprintf("cr%d", c.nextID)
+	ch := make(chan *xmppElement, 1)
+	c.pending[id] = ch
+	iq := fmt.Sprintf(`<iq from="%s" to="%s" type="get" id="%s"><connectionRequest xmlns="%s"><username>%s</username><password>%s</password></connectionRequest></iq>`,
+		xmppEscape(c.jid), xmppEscape(jid), id, XMPPConnReqNamespace, xmppEscape(username), xmppEscape(password))
+	result.Attempts = 1
+	if err := c.write(c.conn, iq); err != nil {
+		delete(c.pending, id)
+		c.disconnect(err)
+		c.mutex.Unlock()
+		return result, errors.Wrap(err, "send connection request")
+	}
+	c.mutex.Unlock()
+
+	var resp *xmppElement
+	select {
+	case resp = <-ch:
+	case <-ctx.Done():
+		c.mutex.Lock()
+		delete(c.pending, id)
+		c.mutex.Unlock()
+		result.Latency = time.Since(start)
+		return result, errors.Wrap(ctx.Err(), "wait connection request")
+	}
+	result.Latency = time.Since(start)
+	if resp == nil {
+		return result, errors.New("xmpp session closed")
+	}
+	if resp.attr("type") == "result" {
+		result.Sent = true
+		return result, nil
+	}
+	return result, errors.Errorf("connection request failed. Error: %v", getXMPPError(resp))
+}
+
+// connect opens the stream, negotiates TLS, authenticates with SASL PLAIN and
+// binds a resource, all bounded by Timeout. c.mutex must be held.
+func (c *XMPPClient) connect(ctx context.Context) error {
+	if c.conn != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.opts.Addr)
+	if err != nil {
+		return errors.Wrap(err, "dial xmpp server")
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	decoder, features, err := c.openStream(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if c.opts.TLSConfig != nil {
+		if features.child("starttls") == nil {
+			conn.Close()
+			return errors.New("xmpp server does not offer starttls")
+		}
+		if _, err := io.WriteString(conn, fmt.Sprintf(`<starttls xmlns="%s"/>`, xmppNSTLS)); err != nil {
+			conn.Close()
+			return errors.Wrap(err, "send starttls")
+		}
+		if e, err := readXMPPElement(decoder); err != nil || e.XMLName.Local != "proceed" {
+			conn.Close()
+			return errors.Errorf("starttls refused: %v", err)
+		}
+		cfg := c.opts.TLSConfig.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName = c.opts.Domain
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return errors.Wrap(err, "tls handshake")
+		}
+		conn = tlsConn
+		decoder, features, err = c.openStream(conn)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	_, secure := conn.(*tls.Conn)
+	if err := c.authenticate(conn, decoder, features, secure); err != nil {
+		conn.Close()
+		return err
+	}
+	decoder, features, err = c.openStream(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	jid, err := c.bind(conn, decoder, features)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	c.conn = conn
+	c.jid = jid
+	c.done = make(chan struct{})
+	go c.read(conn, decoder, c.done)
+	go c.keepAlive(conn, c.done)
+	c.logger.Debug("xmpp connected", zap.String("jid", jid))
+	return nil
+}
+
+// openStream opens a stream on conn and returns its features.
+func (c *XMPPClient) openStream(conn net.Conn) (*xml.Decoder, *xmppElement, error) {
+	header := fmt.Sprintf(`<?xml version="1.0"?><stream:stream to="%s" xmlns="%s" xmlns:stream="%s" version="1.0">`,
+		xmppEscape(c.opts.Domain), xmppNSClient, xmppNSStream)
+	if _, err := io.WriteString(conn, header); err != nil {
+		return nil, nil, errors.Wrap(err, "open stream")
+	}
+	decoder := xml.NewDecoder(conn)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "read stream")
+		}
+		if v, ok := token.(xml.StartElement); ok {
+			if v.Name.Space != xmppNSStream || v.Name.Local != "stream" {
+				return nil, nil, errors.Errorf("unexpected element %v", v.Name.Local)
+			}
+			break
+		}
+	}
+	features, err := readXMPPElement(decoder)
+	if err != nil {
+		return nil, nil, err
+	}
+	if features.XMLName.Local != "features" {
+		return nil, nil, errors.Errorf("unexpected element %v", features.XMLName.Local)
+	}
+	return decoder, features, nil
+}
+
+// authenticate sends the credentials with SASL PLAIN, which is refused on a
+// stream without TLS unless AllowInsecure is set.
+func (c *XMPPClient) authenticate(conn net.Conn, decoder *xml.Decoder, features *xmppElement, secure bool) error {
+	if !secure && !c.opts.AllowInsecure {
+		return errors.New("refuse sasl plain without tls")
+	}
+	plain := false
+	if mechanisms := features.child("mechanisms"); mechanisms != nil {
+		for _, v := range mechanisms.Children {
+			if strings.TrimSpace(v.Text) == "PLAIN" {
+				plain = true
+			}
+		}
+	}
+	if !plain {
+		return errors.New("xmpp server does not offer sasl plain")
+	}
+	credentials := base64.StdEncoding.EncodeToString([]byte("\x00" + c.opts.Username + "\x00" + c.opts.Password))
+	if _, err := io.WriteString(conn, fmt.Sprintf(`<auth xmlns="%s" mechanism="PLAIN">%s</auth>`, xmppNSSASL, credentials)); err != nil {
+		return errors.Wrap(err, "send auth")
+	}
+	e, err := readXMPPElement(decoder)
+	if err != nil {
+		return err
+	}
+	if e.XMLName.Local != "success" {
+		return errors.Errorf("xmpp authentication failed: %v", getXMPPError(e))
+	}
+	return nil
+}
+
+func (c *XMPPClient) bind(conn net.Conn, decoder *xml.Decoder, features *xmppElement) (string, error) {
+	if features.child("bind") == nil {
+		return "", errors.New("xmpp server does not offer bind")
+	}
+	if _, err := io.WriteString(conn, fmt.Sprintf(`<iq type="set" id="bind"><bind xmlns="%s"><resource>%s</resource></bind></iq>`,
+		xmppNSBind, xmppEscape(c.opts.Resource))); err != nil {
+		return "", errors.Wrap(err, "send bind")
+	}
+	e, err := readXMPPElement(decoder)
+	if err != nil {
+		return "", err
+	}
+	if e.attr("type") != "result" {
+		return "", errors.Errorf("xmpp bind failed: %v", getXMPPError(e))
+	}
+	jid := ""
+	if v := e.child("bind"); v != nil {
+		if v2 := v.child("jid"); v2 != nil {
+			jid = strings.TrimSpace(v2.Text)
+		}
+	}
+
+	// servers of RFC 3921 still want a session
+	if v := features.child("session"); v != nil && v.child("optional") == nil {
+		if _, err := io.WriteString(conn, fmt.Sprintf(`<iq type="set" id="session"><session xmlns="%s"/></iq>`, xmppNSSession)); err != nil {
+			return "", errors.Wrap(err, "send session")
+		}
+		e, err := readXMPPElement(decoder)
+		if err != nil {
+			return "", err
+		}
+		if e.attr("type") != "result" {
+			return "", errors.Errorf("xmpp session failed: %v", getXMPPError(e))
+		}
+	}
+	return jid, nil
+}
+
+// read dispatches the stanzas of the server until the stream ends.
+func (c *XMPPClient) read(conn net.Conn, decoder *xml.Decoder, done chan struct{}) {
+	for {
+		e, err := readXMPPElement(decoder)
+		if err != nil {
+			c.mutex.Lock()
+			if c.conn == conn {
+				c.disconnect(err)
+			}
+			c.mutex.Unlock()
+			return
+		}
+		if e.XMLName.Local != "iq" {
+			continue
+		}
+		switch e.attr("type") {
+		case "result", "error":
+			c.mutex.Lock()
+			if ch, ok := c.pending[e.attr("id")]; ok {
+				delete(c.pending, e.attr("id"))
+				ch <- e
+			}
+			c.mutex.Unlock()
+		case "get", "set":
+			// answer pings, refuse anything else
+			reply := fmt.Sprintf(`<iq type="error" to="%s" id="%s"><error type="cancel"><service-unavailable xmlns="%s"/></error></iq>`,
+				xmppEscape(e.attr("from")), xmppEscape(e.attr("id")), xmppNSStanzas)
+			if len(e.Children) > 0 && e.Children[0].XMLName.Space == xmppNSPing {
+				reply = fmt.Sprintf(`<iq type="result" to="%s" id="%s"/>`, xmppEscape(e.attr("from")), xmppEscape(e.attr("id")))
+			}
+			c.mutex.Lock()
+			if c.conn == conn {
+				if err := c.write(conn, reply); err != nil {
+					c.disconnect(err)
+				}
+			}
+			c.mutex.Unlock()
+		}
+	}
+}
+
+func (c *XMPPClient) keepAlive(conn net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(c.opts.KeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			c.mutex.Lock()
+			if c.conn == conn {
+				if err := c.write(conn, " "); err != nil {
+					c.disconnect(err)
+				}
+			}
+			c.mutex.Unlock()
+		}
+	}
+}
+
+// write sends s with a deadline of Timeout, so a stalled server cannot block
+// the senders waiting for c.mutex. c.mutex must be held.
+func (c *XMPPClient) write(conn net.Conn, s string) error {
+	conn.SetWriteDeadline(time.Now().Add(c.opts.Timeout))
+	_, err := io.WriteString(conn, s)
+	return err
+}
+
+// disconnect drops the connection and fails the pending requests. c.mutex
+// must be held.
+func (c *XMPPClient) disconnect(err error) {
+	if c.conn == nil {
+		return
+	}
+	c.logger.Debug("xmpp disconnected", zap.Error(err))
+	c.conn.Close()
+	c.conn = nil
+	c.jid = ""
+	close(c.done)
+	for id, ch := range c.pending {
+		delete(c.pending, id)
+		ch <- nil
+	}
+}
+
+// readXMPPElement reads the next element of the stream.
+func readXMPPElement(decoder *xml.Decoder) (*xmppElement, error) {
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, errors.Wrap(err, "read stream")
+		}
+		switch v := token.(type) {
+		case xml.StartElement:
+			e := &xmppElement{}
+			if err := decoder.DecodeElement(e, &v); err != nil {
+				return nil, errors.Wrap(err, "decode element")
+			}
+			return e, nil
+		case xml.EndElement:
+			return nil, errors.New("stream closed")
+		}
+	}
+}
+
+// getXMPPError returns the condition of an error stanza or a SASL failure.
+func getXMPPError(e *xmppElement) string {
+	if v := e.child("error"); v != nil {
+		e = v
+	}
+	names := []string{}
+	for _, v := range e.Children {
+		if v.XMLName.Local != "text" {
+			names = append(names, v.XMLName.Local)
+		}
+	}
+	if v := e.attr("type"); v != "" {
+		names = append([]string{v}, names...)
+	}
+	if len(names) == 0 {
+		return e.XMLName.Local
+	}
+	return strings.Join(names, " ")
+}
+
+func xmppEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
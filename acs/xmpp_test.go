@@ -0,0 +1,194 @@
+package acs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// newXMPPTestServer starts a local XMPP server, which offers STARTTLS if
+// tlsConfig is set and sends the decoded SASL PLAIN credentials to auths.
+func newXMPPTestServer(t *testing.T, tlsConfig *tls.Config) (string, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	auths := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveXMPPTestConn(conn, tlsConfig, auths)
+		}
+	}()
+	return l.Addr().String(), auths
+}
+
+func openXMPPTestStream(conn net.Conn, features string) (*xml.Decoder, error) {
+	decoder := xml.NewDecoder(conn)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		if v, ok := token.(xml.StartElement); ok && v.Name.Local == "stream" {
+			break
+		}
+	}
+	_, err := fmt.Fprintf(conn, `<?xml version="1.0"?><stream:stream from="example.com" id="s1" xmlns="%s" xmlns:stream="%s" version="1.0"><stream:features>%s</stream:features>`,
+		xmppNSClient, xmppNSStream, features)
+	return decoder, err
+}
+
+func serveXMPPTestConn(conn net.Conn, tlsConfig *tls.Config, auths chan<- string) {
+	defer conn.Close()
+	mechanisms := fmt.Sprintf(`<mechanisms xmlns="%s"><mechanism>PLAIN</mechanism></mechanisms>`, xmppNSSASL)
+	features := mechanisms
+	if tlsConfig != nil {
+		features = fmt.Sprintf(`<starttls xmlns="%s"/>`, xmppNSTLS) + mechanisms
+	}
+	decoder, err := openXMPPTestStream(conn, features)
+	if err != nil {
+		return
+	}
+	e, err := readXMPPElement(decoder)
+	if err != nil {
+		return
+	}
+	if e.XMLName.Local == "starttls" {
+		fmt.Fprintf(conn, `<proceed xmlns="%s"/>`, xmppNSTLS)
+		conn = tls.Server(conn, tlsConfig)
+		defer conn.Close()
+		if decoder, err = openXMPPTestStream(conn, mechanisms); err != nil {
+			return
+		}
+		if e, err = readXMPPElement(decoder); err != nil {
+			return
+		}
+	}
+	if e.XMLName.Local != "auth" {
+		return
+	}
+	credentials, _ := base64.StdEncoding.DecodeString(e.Text)
+	auths <- string(credentials)
+	fmt.Fprintf(conn, `<success xmlns="%s"/>`, xmppNSSASL)
+
+	if decoder, err = openXMPPTestStream(conn, fmt.Sprintf(`<bind xmlns="%s"/>`, xmppNSBind)); err != nil {
+		return
+	}
+	if _, err = readXMPPElement(decoder); err != nil {
+		return
+	}
+	fmt.Fprintf(conn, `<iq type="result" id="bind"><bind xmlns="%s"><jid>acs@example.com/acs</jid></bind></iq>`, xmppNSBind)
+
+	// accept the connection requests with the credentials cpe:secret
+	for {
+		e, err := readXMPPElement(decoder)
+		if err != nil {
+			return
+		}
+		request := e.child("connectionRequest")
+		if e.XMLName.Local != "iq" || request == nil {
+			continue
+		}
+		if v1, v2 := request.child("username"), request.child("password"); v1 != nil && v1.Text == "cpe" && v2 != nil && v2.Text == "secret" {
+			fmt.Fprintf(conn, `<iq type="result" from="%s" to="%s" id="%s"/>`, e.attr("to"), e.attr("from"), e.attr("id"))
+		} else {
+			fmt.Fprintf(conn, `<iq type="error" from="%s" to="%s" id="%s"><error type="cancel"><not-authorized xmlns="%s"/></error></iq>`,
+				e.attr("to"), e.attr("from"), e.attr("id"), xmppNSStanzas)
+		}
+	}
+}
+
+func TestXMPPConnectionRequest(t *testing.T) {
+	addr, auths := newXMPPTestServer(t, nil)
+	c := NewXMPPClient(XMPPOptions{Addr: addr, Domain: "example.com", Username: "acs", Password: "pass", AllowInsecure: true})
+	defer c.Close()
+
+	result, err := c.SendConnectionRequest(context.Background(), "cpe@example.com/cwmp", "cpe", "secret")
+	if err != nil || !result.Sent {
+		t.Fatalf("result %+v error %v", result, err)
+	}
+	if v := <-auths; v != "\x00acs\x00pass" {
+		t.Fatalf("credentials %q", v)
+	}
+	if v := c.JID(); v != "acs@example.com/acs" {
+		t.Fatalf("jid %q", v)
+	}
+
+	result, err = c.SendConnectionRequest(context.Background(), "cpe@example.com/cwmp", "cpe", "wrong")
+	if err == nil || result.Sent {
+		t.Fatalf("wrong password: result %+v error %v", result, err)
+	}
+}
+
+func TestXMPPRefusesPlainWithoutTLS(t *testing.T) {
+	addr, auths := newXMPPTestServer(t, nil)
+	c := NewXMPPClient(XMPPOptions{Addr: addr, Domain: "example.com", Username: "acs", Password: "pass"})
+	defer c.Close()
+
+	if err := c.Connect(context.Background()); err == nil {
+		t.Fatal("connected without tls")
+	}
+	select {
+	case v := <-auths:
+		t.Fatalf("credentials %q sent without tls", v)
+	default:
+	}
+}
+
+func TestXMPPStartTLS(t *testing.T) {
+	now := time.Now()
+	cert, key := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, nil, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	addr, auths := newXMPPTestServer(t, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+	})
+	c := NewXMPPClient(XMPPOptions{Addr: addr, Domain: "example.com", Username: "acs", Password: "pass", TLSConfig: &tls.Config{RootCAs: roots}})
+	defer c.Close()
+
+	result, err := c.SendConnectionRequest(context.Background(), "cpe@example.com/cwmp", "cpe", "secret")
+	if err != nil || !result.Sent {
+		t.Fatalf("result %+v error %v", result, err)
+	}
+	if v := <-auths; v != "\x00acs\x00pass" {
+		t.Fatalf("credentials %q", v)
+	}
+}
+
+func TestXMPPConnectTimeout(t *testing.T) {
+	// a server that accepts but never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c := NewXMPPClient(XMPPOptions{Addr: l.Addr().String(), Domain: "example.com", Timeout: 200 * time.Millisecond, AllowInsecure: true})
+
+	start := time.Now()
+	if err := c.Connect(context.Background()); err == nil {
+		t.Fatal("connected to a stalled server")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("connect took %v", d)
+	}
+}
@@ -93,6 +93,14 @@ func (m *SoapEnvelope) Encode() error {
 		m.Header.ID.XMLName = makeXmlName(ns.Cwmp, "ID")
 		m.Header.ID.Attrs = makeXmlAttrs(ns.SoapEnv, m.Header.ID.Attrs)
 	}
+	if m.Header.HoldRequests != nil {
+		m.Header.HoldRequests.XMLName = makeXmlName(ns.Cwmp, "HoldRequests")
+		m.Header.HoldRequests.Attrs = makeXmlAttrs(ns.SoapEnv, m.Header.HoldRequests.Attrs)
+	}
+	if m.Header.UseCWMPVersion != nil {
+		m.Header.UseCWMPVersion.XMLName = makeXmlName(ns.Cwmp, "UseCWMPVersion")
+		m.Header.UseCWMPVersion.Attrs = makeXmlAttrs(ns.SoapEnv, m.Header.UseCWMPVersion.Attrs)
+	}
 	m.Body.XMLName = makeXmlName(ns.SoapEnv, "Body")
 	if m.Body.Fault != nil {
 		m.Body.Fault.XMLName = makeXmlName(ns.SoapEnv, "Fault")
@@ -117,6 +125,54 @@ func (m *SoapEnvelope) Encode() error {
 	if m.Body.AutonomousTransferCompleteResponse != nil {
 		m.Body.AutonomousTransferCompleteResponse.XMLName = makeXmlName(ns.Cwmp, "AutonomousTransferCompleteResponse")
 	}
+	if m.Body.DUStateChangeComplete != nil {
+		m.Body.DUStateChangeComplete.XMLName = makeXmlName(ns.Cwmp, "DUStateChangeComplete")
+		m.Body.DUStateChangeComplete.Results.Attrs = []xml.Attr{
+			{
+				Name: makeXmlName(ns.SoapEnc, "arrayType"),
+				Value: fmt.Sprintf("%v:OpResultStruct[%v]", ns.Cwmp.Name.Local,
+					len(m.Body.DUStateChangeComplete.Results.OpResultStructs)),
+			},
+		}
+	}
+	if m.Body.DUStateChangeCompleteResponse != nil {
+		m.Body.DUStateChangeCompleteResponse.XMLName = makeXmlName(ns.Cwmp, "DUStateChangeCompleteResponse")
+	}
+	if m.Body.AutonomousDUStateChangeComplete != nil {
+		m.Body.AutonomousDUStateChangeComplete.XMLName = makeXmlName(ns.Cwmp, "AutonomousDUStateChangeComplete")
+		m.Body.AutonomousDUStateChangeComplete.Results.Attrs = []xml.Attr{
+			{
+				Name: makeXmlName(ns.SoapEnc, "arrayType"),
+				Value: fmt.Sprintf("%v:AutonOpResultStruct[%v]", ns.Cwmp.Name.Local,
+					len(m.Body.AutonomousDUStateChangeComplete.Results.AutonOpResultStructs)),
+			},
+		}
+	}
+	if m.Body.AutonomousDUStateChangeCompleteResponse != nil {
+		m.Body.AutonomousDUStateChangeCompleteResponse.XMLName = makeXmlName(ns.Cwmp, "AutonomousDUStateChangeCompleteResponse")
+	}
+	if m.Body.RequestDownload != nil {
+		m.Body.RequestDownload.XMLName = makeXmlName(ns.Cwmp, "RequestDownload")
+		m.Body.RequestDownload.FileTypeArg.Attrs = []xml.Attr{
+			{
+				Name: makeXmlName(ns.SoapEnc, "arrayType"),
+				Value: fmt.Sprintf("%v:ArgStruct[%v]", ns.Cwmp.Name.Local,
+					len(m.Body.RequestDownload.FileTypeArg.ArgStructs)),
+			},
+		}
+	}
+	if m.Body.RequestDownloadResponse != nil {
+		m.Body.RequestDownloadResponse.XMLName = makeXmlName(ns.Cwmp, "RequestDownloadResponse")
+	}
+	if m.Body.Kicked != nil {
+		m.Body.Kicked.XMLName = makeXmlName(ns.Cwmp, "Kicked")
+	}
+	if m.Body.KickedResponse != nil {
+		m.Body.KickedResponse.XMLName = makeXmlName(ns.Cwmp, "KickedResponse")
+	}
+	if m.Body.Raw != nil {
+		m.Body.Raw.XMLName = makeXmlName(ns.Cwmp, m.Body.Raw.XMLName.Local)
+	}
 
 	if m.Body.GetRPCMethods != nil {
 		m.Body.GetRPCMethods.XMLName = makeXmlName(ns.Cwmp, "GetRPCMethods")
@@ -278,6 +334,106 @@ func (m *SoapEnvelope) Encode() error {
 	if m.Body.FactoryResetResponse != nil {
 		m.Body.FactoryResetResponse.XMLName = makeXmlName(ns.Cwmp, "FactoryResetResponse")
 	}
+	if m.Body.ScheduleInform != nil {
+		m.Body.ScheduleInform.XMLName = makeXmlName(ns.Cwmp, "ScheduleInform")
+	}
+	if m.Body.ScheduleInformResponse != nil {
+		m.Body.ScheduleInformResponse.XMLName = makeXmlName(ns.Cwmp, "ScheduleInformResponse")
+	}
+	if m.Body.ScheduleDownload != nil {
+		m.Body.ScheduleDownload.XMLName = makeXmlName(ns.Cwmp, "ScheduleDownload")
+		m.Body.ScheduleDownload.TimeWindowList.Attrs = []xml.Attr{
+			{
+				Name: makeXmlName(ns.SoapEnc, "arrayType"),
+				Value: fmt.Sprintf("%v:TimeWindowStruct[%v]", ns.Cwmp.Name.Local,
+					len(m.Body.ScheduleDownload.TimeWindowList.TimeWindowStructs)),
+			},
+		}
+	}
+	if m.Body.ScheduleDownloadResponse != nil {
+		m.Body.ScheduleDownloadResponse.XMLName = makeXmlName(ns.Cwmp, "ScheduleDownloadResponse")
+	}
+	if m.Body.ChangeDUState != nil {
+		m.Body.ChangeDUState.XMLName = makeXmlName(ns.Cwmp, "ChangeDUState")
+		m.Body.ChangeDUState.Operations.Attrs = []xml.Attr{
+			{
+				Name: makeXmlName(ns.SoapEnc, "arrayType"),
+				Value: fmt.Sprintf("%v:OperationStruct[%v]", ns.Cwmp.Name.Local,
+					len(m.Body.ChangeDUState.Operations.OperationStructs)),
+			},
+		}
+		for _, v := range m.Body.ChangeDUState.Operations.OperationStructs {
+			switch op := v.(type) {
+			case *InstallOpStruct:
+				op.XMLName = xml.Name{Local: "InstallOpStruct"}
+			case *UpdateOpStruct:
+				op.XMLName = xml.Name{Local: "UpdateOpStruct"}
+			case *UninstallOpStruct:
+				op.XMLName = xml.Name{Local: "UninstallOpStruct"}
+			}
+		}
+	}
+	if m.Body.ChangeDUStateResponse != nil {
+		m.Body.ChangeDUStateResponse.XMLName = makeXmlName(ns.Cwmp, "ChangeDUStateResponse")
+	}
+	if m.Body.GetQueuedTransfers != nil {
+		m.Body.GetQueuedTransfers.XMLName = makeXmlName(ns.Cwmp, "GetQueuedTransfers")
+	}
+	if m.Body.GetQueuedTransfersResponse != nil {
+		m.Body.GetQueuedTransfersResponse.XMLName = makeXmlName(ns.Cwmp, "GetQueuedTransfersResponse")
+		m.Body.GetQueuedTransfersResponse.TransferList.Attrs = []xml.Attr{
+			{
+				Name: makeXmlName(ns.SoapEnc, "arrayType"),
+				Value: fmt.Sprintf("%v:QueuedTransferStruct[%v]", ns.Cwmp.Name.Local,
+					len(m.Body.GetQueuedTransfersResponse.TransferList.QueuedTransferStructs)),
+			},
+		}
+	}
+	if m.Body.GetAllQueuedTransfers != nil {
+		m.Body.GetAllQueuedTransfers.XMLName = makeXmlName(ns.Cwmp, "GetAllQueuedTransfers")
+	}
+	if m.Body.GetAllQueuedTransfersResponse != nil {
+		m.Body.GetAllQueuedTransfersResponse.XMLName = makeXmlName(ns.Cwmp, "GetAllQueuedTransfersResponse")
+		m.Body.GetAllQueuedTransfersResponse.TransferList.Attrs = []xml.Attr{
+			{
+				Name: makeXmlName(ns.SoapEnc, "arrayType"),
+				Value: fmt.Sprintf("%v:AllQueuedTransferStruct[%v]", ns.Cwmp.Name.Local,
+					len(m.Body.GetAllQueuedTransfersResponse.TransferList.AllQueuedTransferStructs)),
+			},
+		}
+	}
+	if m.Body.CancelTransfer != nil {
+		m.Body.CancelTransfer.XMLName = makeXmlName(ns.Cwmp, "CancelTransfer")
+	}
+	if m.Body.CancelTransferResponse != nil {
+		m.Body.CancelTransferResponse.XMLName = makeXmlName(ns.Cwmp, "CancelTransferResponse")
+	}
+	if m.Body.SetVouchers != nil {
+		m.Body.SetVouchers.XMLName = makeXmlName(ns.Cwmp, "SetVouchers")
+		m.Body.SetVouchers.VoucherList.Attrs = []xml.Attr{
+			{
+				Name: makeXmlName(ns.SoapEnc, "arrayType"),
+				Value: fmt.Sprintf("%v:base64[%v]", ns.Xsd.Name.Local,
+					len(m.Body.SetVouchers.VoucherList.Base64s)),
+			},
+		}
+	}
+	if m.Body.SetVouchersResponse != nil {
+		m.Body.SetVouchersResponse.XMLName = makeXmlName(ns.Cwmp, "SetVouchersResponse")
+	}
+	if m.Body.GetOptions != nil {
+		m.Body.GetOptions.XMLName = makeXmlName(ns.Cwmp, "GetOptions")
+	}
+	if m.Body.GetOptionsResponse != nil {
+		m.Body.GetOptionsResponse.XMLName = makeXmlName(ns.Cwmp, "GetOptionsResponse")
+		m.Body.GetOptionsResponse.OptionList.Attrs = []xml.Attr{
+			{
+				Name: makeXmlName(ns.SoapEnc, "arrayType"),
+				Value: fmt.Sprintf("%v:OptionStruct[%v]", ns.Cwmp.Name.Local,
+					len(m.Body.GetOptionsResponse.OptionList.OptionStructs)),
+			},
+		}
+	}
 
 	return nil
 }
@@ -289,8 +445,9 @@ type CwmpID struct {
 }
 type HoldRequests struct {
 	XMLName        xml.Name
-	Text           string `xml:",chardata"`
-	MustUnderstand string `xml:"mustUnderstand,attr"` // must "1"
+	Text           string     `xml:",chardata"`
+	Attrs          []xml.Attr `xml:",any,attr"`
+	MustUnderstand string     `xml:"mustUnderstand,attr,omitempty"` // must "1"
 }
 type SessionTimeout struct {
 	XMLName        xml.Name
@@ -304,8 +461,9 @@ type SupportedCWMPVersions struct {
 }
 type UseCWMPVersion struct {
 	XMLName        xml.Name
-	Text           string `xml:",chardata"`
-	MustUnderstand string `xml:"mustUnderstand,attr"` // must "1"
+	Text           string     `xml:",chardata"`
+	Attrs          []xml.Attr `xml:",any,attr"`
+	MustUnderstand string     `xml:"mustUnderstand,attr,omitempty"` // must "1"
 }
 
 type SoapHeader struct {
@@ -347,6 +505,22 @@ type SoapBody struct {
 	RebootResponse                 *RebootResponse                 `xml:"RebootResponse,omitempty"`
 	FactoryReset                   *FactoryReset                   `xml:"FactoryReset,omitempty"`
 	FactoryResetResponse           *FactoryResetResponse           `xml:"FactoryResetResponse,omitempty"`
+	ScheduleInform                 *ScheduleInform                 `xml:"ScheduleInform,omitempty"`
+	ScheduleInformResponse         *ScheduleInformResponse         `xml:"ScheduleInformResponse,omitempty"`
+	ScheduleDownload               *ScheduleDownload               `xml:"ScheduleDownload,omitempty"`
+	ScheduleDownloadResponse       *ScheduleDownloadResponse       `xml:"ScheduleDownloadResponse,omitempty"`
+	ChangeDUState                  *ChangeDUState                  `xml:"ChangeDUState,omitempty"`
+	ChangeDUStateResponse          *ChangeDUStateResponse          `xml:"ChangeDUStateResponse,omitempty"`
+	GetQueuedTransfers             *GetQueuedTransfers             `xml:"GetQueuedTransfers,omitempty"`
+	GetQueuedTransfersResponse     *GetQueuedTransfersResponse     `xml:"GetQueuedTransfersResponse,omitempty"`
+	GetAllQueuedTransfers          *GetAllQueuedTransfers          `xml:"GetAllQueuedTransfers,omitempty"`
+	GetAllQueuedTransfersResponse  *GetAllQueuedTransfersResponse  `xml:"GetAllQueuedTransfersResponse,omitempty"`
+	CancelTransfer                 *CancelTransfer                 `xml:"CancelTransfer,omitempty"`
+	CancelTransferResponse         *CancelTransferResponse         `xml:"CancelTransferResponse,omitempty"`
+	SetVouchers                    *SetVouchers                    `xml:"SetVouchers,omitempty"`
+	SetVouchersResponse            *SetVouchersResponse            `xml:"SetVouchersResponse,omitempty"`
+	GetOptions                     *GetOptions                     `xml:"GetOptions,omitempty"`
+	GetOptionsResponse             *GetOptionsResponse             `xml:"GetOptionsResponse,omitempty"`
 
 	Inform                             *Inform                             `xml:"Inform,omitempty"`
 	InformResponse                     *InformResponse                     `xml:"InformResponse,omitempty"`
@@ -354,6 +528,17 @@ type SoapBody struct {
 	TransferCompleteResponse           *TransferCompleteResponse           `xml:"TransferCompleteResponse,omitempty"`
 	AutonomousTransferComplete         *AutonomousTransferComplete         `xml:"AutonomousTransferComplete,omitempty"`
 	AutonomousTransferCompleteResponse *AutonomousTransferCompleteResponse `xml:"AutonomousTransferCompleteResponse,omitempty"`
+
+	DUStateChangeComplete                   *DUStateChangeComplete                   `xml:"DUStateChangeComplete,omitempty"`
+	DUStateChangeCompleteResponse           *DUStateChangeCompleteResponse           `xml:"DUStateChangeCompleteResponse,omitempty"`
+	AutonomousDUStateChangeComplete         *AutonomousDUStateChangeComplete         `xml:"AutonomousDUStateChangeComplete,omitempty"`
+	AutonomousDUStateChangeCompleteResponse *AutonomousDUStateChangeCompleteResponse `xml:"AutonomousDUStateChangeCompleteResponse,omitempty"`
+	RequestDownload                         *RequestDownload                         `xml:"RequestDownload,omitempty"`
+	RequestDownloadResponse                 *RequestDownloadResponse                 `xml:"RequestDownloadResponse,omitempty"`
+	Kicked                                  *Kicked                                  `xml:"Kicked,omitempty"`
+	KickedResponse                          *KickedResponse                          `xml:"KickedResponse,omitempty"`
+
+	Raw *RawBody `xml:",any,omitempty"` // any element not modeled above, e.g. vendor specific methods
 }
 
 type SoapFault struct {
@@ -374,6 +559,15 @@ func CreateSoapFault(code int, err error) *SoapFault {
 	return fault
 }
 
+// CreateSoapFaultWithDetail returns a fault that repeats code and err in the
+// cwmp:Fault of its detail.
+func CreateSoapFaultWithDetail(code int, err error) *SoapFault {
+	fault := CreateSoapFault(code, err)
+	fault.Detail.Fault.FaultCode = fault.FaultCode
+	fault.Detail.Fault.FaultString = fault.FaultString
+	return fault
+}
+
 func (m SoapFault) String() string {
 	return fmt.Sprintf("[Code=%v String=%v Deailt=%v]", m.FaultCode, m.FaultString, m.Detail)
 }
@@ -477,6 +671,14 @@ type AccessList struct {
 	//ArrayType string   `xml:"soap-enc:arrayType,attr"`
 }
 
+type VoucherList struct {
+	XMLName xml.Name
+	Text    string     `xml:",chardata"`
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Base64s []string   `xml:"base64"`
+	//ArrayType string   `xml:"soap-enc:arrayType,attr"`
+}
+
 type ParameterValueStruct struct {
 	XMLName xml.Name
 	Text    string         `xml:",chardata"`
@@ -535,6 +737,96 @@ type ParameterAttributesStruct struct {
 	AccessList   AccessList `xml:"AccessList"`
 }
 
+type TimeWindowStruct struct {
+	XMLName     xml.Name
+	Text        string `xml:",chardata"`
+	WindowStart uint   `xml:"WindowStart"`
+	WindowEnd   uint   `xml:"WindowEnd"`
+	WindowMode  string `xml:"WindowMode"`
+	UserMessage string `xml:"UserMessage"`
+	MaxRetries  int    `xml:"MaxRetries"`
+}
+
+func (m TimeWindowStruct) String() string {
+	return fmt.Sprintf("[Start=%v End=%v Mode=%v MaxRetries=%v]", m.WindowStart, m.WindowEnd, m.WindowMode, m.MaxRetries)
+}
+
+type TimeWindowList struct {
+	XMLName           xml.Name
+	Text              string              `xml:",chardata"`
+	Attrs             []xml.Attr          `xml:",any,attr"`
+	TimeWindowStructs []*TimeWindowStruct `xml:"TimeWindowStruct"`
+	//ArrayType         string             `xml:"soap-enc:arrayType,attr"`
+}
+
+type QueuedTransferStruct struct {
+	XMLName    xml.Name
+	Text       string `xml:",chardata"`
+	CommandKey string `xml:"CommandKey"`
+	State      int    `xml:"State"`
+}
+
+func (m QueuedTransferStruct) String() string {
+	return fmt.Sprintf("[CommandKey=%v State=%v]", m.CommandKey, m.State)
+}
+
+type AllQueuedTransferStruct struct {
+	XMLName        xml.Name
+	Text           string `xml:",chardata"`
+	CommandKey     string `xml:"CommandKey"`
+	State          int    `xml:"State"`
+	IsDownload     bool   `xml:"IsDownload"`
+	FileType       string `xml:"FileType"`
+	FileSize       uint   `xml:"FileSize"`
+	TargetFileName string `xml:"TargetFileName"`
+}
+
+func (m AllQueuedTransferStruct) String() string {
+	return fmt.Sprintf("[CommandKey=%v State=%v IsDownload=%v FileType=%v FileSize=%v TargetFileName=%v]",
+		m.CommandKey, m.State, m.IsDownload, m.FileType, m.FileSize, m.TargetFileName)
+}
+
+type TransferListOfQueuedTransfer struct {
+	XMLName               xml.Name
+	Text                  string                  `xml:",chardata"`
+	Attrs                 []xml.Attr              `xml:",any,attr"`
+	QueuedTransferStructs []*QueuedTransferStruct `xml:"QueuedTransferStruct"`
+	//ArrayType             string                 `xml:"soap-enc:arrayType,attr"`
+}
+
+type TransferListOfAllQueuedTransfer struct {
+	XMLName                  xml.Name
+	Text                     string                     `xml:",chardata"`
+	Attrs                    []xml.Attr                 `xml:",any,attr"`
+	AllQueuedTransferStructs []*AllQueuedTransferStruct `xml:"AllQueuedTransferStruct"`
+	//ArrayType                string                    `xml:"soap-enc:arrayType,attr"`
+}
+
+type OptionStruct struct {
+	XMLName        xml.Name
+	Text           string `xml:",chardata"`
+	OptionName     string `xml:"OptionName"`
+	VoucherSN      string `xml:"VoucherSN"`
+	State          uint   `xml:"State"`
+	Mode           int    `xml:"Mode"`
+	StartDate      string `xml:"StartDate"`
+	ExpirationDate string `xml:"ExpirationDate"`
+	IsTransferable bool   `xml:"IsTransferable"`
+}
+
+func (m OptionStruct) String() string {
+	return fmt.Sprintf("[OptionName=%v VoucherSN=%v State=%v Mode=%v StartDate=%v ExpirationDate=%v IsTransferable=%v]",
+		m.OptionName, m.VoucherSN, m.State, m.Mode, m.StartDate, m.ExpirationDate, m.IsTransferable)
+}
+
+type OptionList struct {
+	XMLName       xml.Name
+	Text          string          `xml:",chardata"`
+	Attrs         []xml.Attr      `xml:",any,attr"`
+	OptionStructs []*OptionStruct `xml:"OptionStruct"`
+	//ArrayType     string         `xml:"soap-enc:arrayType,attr"`
+}
+
 type ParameterListOfParameterValue struct {
 	XMLName               xml.Name
 	Text                  string                  `xml:",chardata"`
@@ -636,6 +928,140 @@ type AutonomousTransferCompleteResponse struct {
 	Text    string `xml:",chardata"`
 }
 
+type OpResultStruct struct {
+	XMLName              xml.Name
+	Text                 string      `xml:",chardata"`
+	UUID                 string      `xml:"UUID"`
+	DeploymentUnitRef    string      `xml:"DeploymentUnitRef"`
+	Version              string      `xml:"Version"`
+	CurrentState         string      `xml:"CurrentState"`
+	Resolved             bool        `xml:"Resolved"`
+	ExecutionUnitRefList string      `xml:"ExecutionUnitRefList"`
+	StartTime            string      `xml:"StartTime"`
+	CompleteTime         string      `xml:"CompleteTime"`
+	Fault                FaultStruct `xml:"Fault"`
+}
+
+func (m OpResultStruct) String() string {
+	return fmt.Sprintf("[UUID=%v DeploymentUnitRef=%v Version=%v CurrentState=%v Resolved=%v FaultCode=%v]",
+		m.UUID, m.DeploymentUnitRef, m.Version, m.CurrentState, m.Resolved, m.Fault.FaultCode)
+}
+
+type OpResultList struct {
+	XMLName         xml.Name
+	Text            string            `xml:",chardata"`
+	Attrs           []xml.Attr        `xml:",any,attr"`
+	OpResultStructs []*OpResultStruct `xml:"OpResultStruct"`
+	//ArrayType       string           `xml:"soap-enc:arrayType,attr"`
+}
+
+type DUStateChangeComplete struct {
+	XMLName    xml.Name
+	Text       string       `xml:",chardata"`
+	Results    OpResultList `xml:"Results"`
+	CommandKey string       `xml:"CommandKey"`
+}
+type DUStateChangeCompleteResponse struct {
+	XMLName xml.Name
+	Text    string `xml:",chardata"`
+}
+
+type AutonOpResultStruct struct {
+	XMLName              xml.Name
+	Text                 string      `xml:",chardata"`
+	UUID                 string      `xml:"UUID"`
+	DeploymentUnitRef    string      `xml:"DeploymentUnitRef"`
+	Version              string      `xml:"Version"`
+	CurrentState         string      `xml:"CurrentState"`
+	Resolved             bool        `xml:"Resolved"`
+	ExecutionUnitRefList string      `xml:"ExecutionUnitRefList"`
+	StartTime            string      `xml:"StartTime"`
+	CompleteTime         string      `xml:"CompleteTime"`
+	Fault                FaultStruct `xml:"Fault"`
+	OperationPerformed   string      `xml:"OperationPerformed"`
+}
+
+func (m AutonOpResultStruct) String() string {
+	return fmt.Sprintf("[UUID=%v DeploymentUnitRef=%v Version=%v CurrentState=%v Resolved=%v OperationPerformed=%v FaultCode=%v]",
+		m.UUID, m.DeploymentUnitRef, m.Version, m.CurrentState, m.Resolved, m.OperationPerformed, m.Fault.FaultCode)
+}
+
+type AutonOpResultList struct {
+	XMLName              xml.Name
+	Text                 string                 `xml:",chardata"`
+	Attrs                []xml.Attr             `xml:",any,attr"`
+	AutonOpResultStructs []*AutonOpResultStruct `xml:"AutonOpResultStruct"`
+	//ArrayType            string                `xml:"soap-enc:arrayType,attr"`
+}
+
+type AutonomousDUStateChangeComplete struct {
+	XMLName xml.Name
+	Text    string            `xml:",chardata"`
+	Results AutonOpResultList `xml:"Results"`
+}
+type AutonomousDUStateChangeCompleteResponse struct {
+	XMLName xml.Name
+	Text    string `xml:",chardata"`
+}
+
+type ArgStruct struct {
+	XMLName xml.Name
+	Text    string `xml:",chardata"`
+	Name    string `xml:"Name"`
+	Value   string `xml:"Value"`
+}
+
+func (m ArgStruct) String() string {
+	return fmt.Sprintf("%v=%v", m.Name, m.Value)
+}
+
+type FileTypeArg struct {
+	XMLName    xml.Name
+	Text       string       `xml:",chardata"`
+	Attrs      []xml.Attr   `xml:",any,attr"`
+	ArgStructs []*ArgStruct `xml:"ArgStruct"`
+	//ArrayType  string      `xml:"soap-enc:arrayType,attr"`
+}
+
+type RequestDownload struct {
+	XMLName     xml.Name
+	Text        string      `xml:",chardata"`
+	FileType    string      `xml:"FileType"`
+	FileTypeArg FileTypeArg `xml:"FileTypeArg"`
+}
+
+func (m RequestDownload) String() string {
+	out := []string{}
+	for _, v := range m.FileTypeArg.ArgStructs {
+		out = append(out, v.String())
+	}
+	return fmt.Sprintf("[FileType=%v FileTypeArg=[%v]]", m.FileType, strings.Join(out, ", "))
+}
+
+type RequestDownloadResponse struct {
+	XMLName xml.Name
+	Text    string `xml:",chardata"`
+}
+
+type Kicked struct {
+	XMLName xml.Name
+	Text    string `xml:",chardata"`
+	Command string `xml:"Command"`
+	Referer string `xml:"Referer"`
+	Arg     string `xml:"Arg"`
+	Next    string `xml:"Next"`
+}
+
+func (m Kicked) String() string {
+	return fmt.Sprintf("[Command=%v Referer=%v Arg=%v Next=%v]", m.Command, m.Referer, m.Arg, m.Next)
+}
+
+type KickedResponse struct {
+	XMLName xml.Name
+	Text    string `xml:",chardata"`
+	NextURL string `xml:"NextURL"`
+}
+
 type GetRPCMethods struct {
 	XMLName xml.Name
 	Text    string `xml:",chardata"`
@@ -785,3 +1211,139 @@ type FactoryResetResponse struct {
 	XMLName xml.Name
 	Text    string `xml:",chardata"`
 }
+
+type ScheduleInform struct {
+	XMLName      xml.Name
+	Text         string `xml:",chardata"`
+	DelaySeconds uint   `xml:"DelaySeconds"`
+	CommandKey   string `xml:"CommandKey"`
+}
+type ScheduleInformResponse struct {
+	XMLName xml.Name
+	Text    string `xml:",chardata"`
+}
+
+type ScheduleDownload struct {
+	XMLName        xml.Name
+	Text           string         `xml:",chardata"`
+	CommandKey     string         `xml:"CommandKey"`
+	FileType       string         `xml:"FileType"`
+	URL            string         `xml:"URL"`
+	Username       string         `xml:"Username"`
+	Password       string         `xml:"Password"`
+	FileSize       uint           `xml:"FileSize"`
+	TargetFileName string         `xml:"TargetFileName"`
+	TimeWindowList TimeWindowList `xml:"TimeWindowList"`
+}
+type ScheduleDownloadResponse struct {
+	XMLName xml.Name
+	Text    string `xml:",chardata"`
+}
+
+type InstallOpStruct struct {
+	XMLName         xml.Name
+	Text            string `xml:",chardata"`
+	URL             string `xml:"URL"`
+	UUID            string `xml:"UUID"`
+	Username        string `xml:"Username"`
+	Password        string `xml:"Password"`
+	ExecutionEnvRef string `xml:"ExecutionEnvRef"`
+}
+type UpdateOpStruct struct {
+	XMLName  xml.Name
+	Text     string `xml:",chardata"`
+	UUID     string `xml:"UUID"`
+	Version  string `xml:"Version"`
+	URL      string `xml:"URL"`
+	Username string `xml:"Username"`
+	Password string `xml:"Password"`
+}
+type UninstallOpStruct struct {
+	XMLName         xml.Name
+	Text            string `xml:",chardata"`
+	UUID            string `xml:"UUID"`
+	Version         string `xml:"Version"`
+	ExecutionEnvRef string `xml:"ExecutionEnvRef"`
+}
+
+type Operations struct {
+	XMLName xml.Name
+	Text    string     `xml:",chardata"`
+	Attrs   []xml.Attr `xml:",any,attr"`
+	// OperationStructs holds *InstallOpStruct, *UpdateOpStruct or *UninstallOpStruct
+	// values, which the CPE applies in order.
+	OperationStructs []any `xml:",any"`
+	//ArrayType        string `xml:"soap-enc:arrayType,attr"`
+}
+
+type ChangeDUState struct {
+	XMLName    xml.Name
+	Text       string     `xml:",chardata"`
+	Operations Operations `xml:"Operations"`
+	CommandKey string     `xml:"CommandKey"`
+}
+type ChangeDUStateResponse struct {
+	XMLName xml.Name
+	Text    string `xml:",chardata"`
+}
+
+type GetQueuedTransfers struct {
+	XMLName xml.Name
+	Text    string `xml:",chardata"`
+}
+type GetQueuedTransfersResponse struct {
+	XMLName      xml.Name
+	Text         string                       `xml:",chardata"`
+	TransferList TransferListOfQueuedTransfer `xml:"TransferList"`
+}
+
+type GetAllQueuedTransfers struct {
+	XMLName xml.Name
+	Text    string `xml:",chardata"`
+}
+type GetAllQueuedTransfersResponse struct {
+	XMLName      xml.Name
+	Text         string                          `xml:",chardata"`
+	TransferList TransferListOfAllQueuedTransfer `xml:"TransferList"`
+}
+
+type CancelTransfer struct {
+	XMLName    xml.Name
+	Text       string `xml:",chardata"`
+	CommandKey string `xml:"CommandKey"`
+}
+type CancelTransferResponse struct {
+	XMLName xml.Name
+	Text    string `xml:",chardata"`
+}
+
+type SetVouchers struct {
+	XMLName     xml.Name
+	Text        string      `xml:",chardata"`
+	VoucherList VoucherList `xml:"VoucherList"`
+}
+type SetVouchersResponse struct {
+	XMLName xml.Name
+	Text    string `xml:",chardata"`
+}
+
+type GetOptions struct {
+	XMLName    xml.Name
+	Text       string `xml:",chardata"`
+	OptionName string `xml:"OptionName"`
+}
+type GetOptionsResponse struct {
+	XMLName    xml.Name
+	Text       string     `xml:",chardata"`
+	OptionList OptionList `xml:"OptionList"`
+}
+
+type RawBody struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	InnerXML string     `xml:",innerxml"`
+}
+
+func (m RawBody) String() string {
+	return fmt.Sprintf("[%v %v]", m.XMLName.Local, m.InnerXML)
+}
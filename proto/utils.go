@@ -1,16 +1,26 @@
 package proto
 
 import (
+	"bytes"
 	"encoding/xml"
+	"io"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 	"unicode/utf8"
+
+	"github.com/pkg/errors"
 )
 
 func CreateEnvelopeFault(id string, ns SoapNamespace, code int, err error) *SoapEnvelope {
 	return CreateEnvelope(id, ns, CreateSoapFault(code, err))
 }
 
+func CreateEnvelopeFaultWithDetail(id string, ns SoapNamespace, code int, err error) *SoapEnvelope {
+	return CreateEnvelope(id, ns, CreateSoapFaultWithDetail(code, err))
+}
+
 func CreateEnvelope(id string, ns SoapNamespace, body any) *SoapEnvelope {
 	msg := &SoapEnvelope{
 		NS: ns,
@@ -36,6 +46,22 @@ func CreateEnvelope(id string, ns SoapNamespace, body any) *SoapEnvelope {
 		msg.Body.AutonomousTransferComplete = v
 	case *AutonomousTransferCompleteResponse:
 		msg.Body.AutonomousTransferCompleteResponse = v
+	case *DUStateChangeComplete:
+		msg.Body.DUStateChangeComplete = v
+	case *DUStateChangeCompleteResponse:
+		msg.Body.DUStateChangeCompleteResponse = v
+	case *AutonomousDUStateChangeComplete:
+		msg.Body.AutonomousDUStateChangeComplete = v
+	case *AutonomousDUStateChangeCompleteResponse:
+		msg.Body.AutonomousDUStateChangeCompleteResponse = v
+	case *RequestDownload:
+		msg.Body.RequestDownload = v
+	case *RequestDownloadResponse:
+		msg.Body.RequestDownloadResponse = v
+	case *Kicked:
+		msg.Body.Kicked = v
+	case *KickedResponse:
+		msg.Body.KickedResponse = v
 	case *GetRPCMethods:
 		msg.Body.GetRPCMethods = v
 	case *GetRPCMethodsResponse:
@@ -84,6 +110,40 @@ func CreateEnvelope(id string, ns SoapNamespace, body any) *SoapEnvelope {
 		msg.Body.FactoryReset = v
 	case *FactoryResetResponse:
 		msg.Body.FactoryResetResponse = v
+	case *ScheduleInform:
+		msg.Body.ScheduleInform = v
+	case *ScheduleInformResponse:
+		msg.Body.ScheduleInformResponse = v
+	case *ScheduleDownload:
+		msg.Body.ScheduleDownload = v
+	case *ScheduleDownloadResponse:
+		msg.Body.ScheduleDownloadResponse = v
+	case *ChangeDUState:
+		msg.Body.ChangeDUState = v
+	case *ChangeDUStateResponse:
+		msg.Body.ChangeDUStateResponse = v
+	case *GetQueuedTransfers:
+		msg.Body.GetQueuedTransfers = v
+	case *GetQueuedTransfersResponse:
+		msg.Body.GetQueuedTransfersResponse = v
+	case *GetAllQueuedTransfers:
+		msg.Body.GetAllQueuedTransfers = v
+	case *GetAllQueuedTransfersResponse:
+		msg.Body.GetAllQueuedTransfersResponse = v
+	case *CancelTransfer:
+		msg.Body.CancelTransfer = v
+	case *CancelTransferResponse:
+		msg.Body.CancelTransferResponse = v
+	case *SetVouchers:
+		msg.Body.SetVouchers = v
+	case *SetVouchersResponse:
+		msg.Body.SetVouchersResponse = v
+	case *GetOptions:
+		msg.Body.GetOptions = v
+	case *GetOptionsResponse:
+		msg.Body.GetOptionsResponse = v
+	case *RawBody:
+		msg.Body.Raw = v
 	case *SoapFault:
 		msg.Body.Fault = v
 	}
@@ -91,6 +151,94 @@ func CreateEnvelope(id string, ns SoapNamespace, body any) *SoapEnvelope {
 	return msg
 }
 
+// CreateRawBody creates a body element named method, rendering values as child
+// elements ordered by name. It fails if method or a value name is not an XML
+// name without a colon.
+func CreateRawBody(method string, values map[string]string) (*RawBody, error) {
+	if !IsXMLName(method) {
+		return nil, errors.Errorf("invalid method name %q", method)
+	}
+	names := []string{}
+	for k := range values {
+		if !IsXMLName(k) {
+			return nil, errors.Errorf("invalid element name %q", k)
+		}
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, k := range names {
+		buf.WriteString("<" + k + ">")
+		xml.EscapeText(&buf, []byte(values[k]))
+		buf.WriteString("</" + k + ">")
+	}
+	return &RawBody{
+		XMLName:  xml.Name{Local: method},
+		InnerXML: buf.String(),
+	}, nil
+}
+
+// CreateRawBodyXML creates a body element named method whose content is
+// innerXML, sent as is. It fails if method is not an XML name without a colon
+// or innerXML is not well-formed.
+func CreateRawBodyXML(method string, innerXML string) (*RawBody, error) {
+	if !IsXMLName(method) {
+		return nil, errors.Errorf("invalid method name %q", method)
+	}
+	// the content must stay inside the method element
+	decoder := xml.NewDecoder(strings.NewReader("<x>" + innerXML + "</x>"))
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "parse raw xml")
+		}
+		if depth == 0 && decoder.InputOffset() > 3 {
+			return nil, errors.New("raw xml closes the method element")
+		}
+		switch token.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+	return &RawBody{
+		XMLName:  xml.Name{Local: method},
+		InnerXML: innerXML,
+	}, nil
+}
+
+// IsXMLName reports whether name matches the Name production of XML 1.0
+// without colons, so it is a valid element name in any namespace.
+func IsXMLName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if !isXMLNameStartChar(r) && (i == 0 || !isXMLNameChar(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+func isXMLNameStartChar(r rune) bool {
+	return r >= 'A' && r <= 'Z' || r == '_' || r >= 'a' && r <= 'z' ||
+		r >= 0xC0 && r <= 0xD6 || r >= 0xD8 && r <= 0xF6 || r >= 0xF8 && r <= 0x2FF ||
+		r >= 0x370 && r <= 0x37D || r >= 0x37F && r <= 0x1FFF || r >= 0x200C && r <= 0x200D ||
+		r >= 0x2070 && r <= 0x218F || r >= 0x2C00 && r <= 0x2FEF || r >= 0x3001 && r <= 0xD7FF ||
+		r >= 0xF900 && r <= 0xFDCF || r >= 0xFDF0 && r <= 0xFFFD || r >= 0x10000 && r <= 0xEFFFF
+}
+
+func isXMLNameChar(r rune) bool {
+	return r == '-' || r == '.' || r >= '0' && r <= '9' || r == 0xB7 ||
+		r >= 0x300 && r <= 0x36F || r >= 0x203F && r <= 0x2040
+}
+
 func CreateEnvelopeWithRequest(req *SoapEnvelope) *SoapEnvelope {
 	resp := &SoapEnvelope{
 		NS: req.NS,
@@ -106,6 +254,73 @@ func CreateEnvelopeWithRequest(req *SoapEnvelope) *SoapEnvelope {
 	return resp
 }
 
+// GetBodyElementName returns the local name of the first element in the SOAP
+// Body, including elements that SoapBody does not model. It returns an empty
+// string if the Body is empty or missing.
+func GetBodyElementName(data []byte) (string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	inBody := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		switch v := token.(type) {
+		case xml.StartElement:
+			if inBody {
+				return v.Name.Local, nil
+			}
+			depth++
+			if depth == 2 && v.Name.Local == "Body" {
+				inBody = true
+			}
+		case xml.EndElement:
+			if inBody {
+				return "", nil
+			}
+			depth--
+		}
+	}
+}
+
+// SplitEnvelopes splits an HTTP body that carries one or more SOAP envelopes
+// into one chunk per envelope.
+func SplitEnvelopes(data []byte) ([][]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	out := [][]byte{}
+	depth := 0
+	var start int64
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err == io.EOF {
+			if depth != 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch token.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				start = offset
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+			if depth == 0 {
+				out = append(out, data[start:decoder.InputOffset()])
+			}
+		}
+	}
+}
+
 func CleanXMLData(data []byte) []byte {
 	var cleanedData strings.Builder
 	for len(data) > 0 {
@@ -123,6 +338,10 @@ func CleanXMLData(data []byte) []byte {
 }
 
 func makeXmlName(attr xml.Attr, local string) xml.Name {
+	// drop any prefix from a previous Encode
+	if i := strings.LastIndex(local, ":"); i >= 0 {
+		local = local[i+1:]
+	}
 	return xml.Name{
 		Space: "",
 		Local: attr.Name.Local + ":" + local,
@@ -145,6 +364,62 @@ func makeXmlAttrs(ns xml.Attr, src []xml.Attr) []xml.Attr {
 	return out
 }
 
+var cwmpNamespaces = map[string]string{
+	"1.0": XMLNS_CWMP_1_0,
+	"1.1": XMLNS_CWMP_1_1,
+	"1.2": XMLNS_CWMP_1_2,
+	"1.3": XMLNS_CWMP_1_3,
+	"1.4": XMLNS_CWMP_1_4,
+}
+
+// GetCwmpNamespace returns the cwmp namespace of a CWMP version like "1.2",
+// or an empty string if the version is unknown.
+func GetCwmpNamespace(version string) string {
+	return cwmpNamespaces[version]
+}
+
+// GetCwmpVersion returns the CWMP version of a cwmp namespace, or an empty
+// string if the namespace is unknown.
+func GetCwmpVersion(namespace string) string {
+	for version, v := range cwmpNamespaces {
+		if v == namespace {
+			return version
+		}
+	}
+	return ""
+}
+
+// ParseCwmpVersions parses the comma separated list of a SupportedCWMPVersions
+// header, skipping unknown versions.
+func ParseCwmpVersions(value string) []string {
+	out := []string{}
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if GetCwmpNamespace(v) != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// CompareCwmpVersions compares the "major.minor" versions a and b by number,
+// it returns -1, 0 or 1. Unparsable parts count as 0.
+func CompareCwmpVersions(a string, b string) int {
+	major1, minor1, _ := strings.Cut(a, ".")
+	major2, minor2, _ := strings.Cut(b, ".")
+	for _, v := range [][2]string{{major1, major2}, {minor1, minor2}} {
+		x, _ := strconv.Atoi(strings.TrimSpace(v[0]))
+		y, _ := strconv.Atoi(strings.TrimSpace(v[1]))
+		if x < y {
+			return -1
+		}
+		if x > y {
+			return 1
+		}
+	}
+	return 0
+}
+
 func ParseTime(value string) (time.Time, error) {
 	var layouts = []string{
 		"2006-01-02T15:04:05",
@@ -0,0 +1,114 @@
+package proto
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareCwmpVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.2", "1.4", -1},
+		{"1.4", "1.2", 1},
+		{"1.10", "1.4", 1},
+		{"1.4", "1.10", -1},
+		{"2.0", "1.4", 1},
+		{" 1.3", "1.3 ", 0},
+		{"1", "1.0", 0},
+		{"", "1.0", -1},
+	}
+	for _, tt := range tests {
+		if got := CompareCwmpVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareCwmpVersions(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestParseCwmpVersions(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"1.0,1.1,1.2", []string{"1.0", "1.1", "1.2"}},
+		{" 1.4 , 1.3", []string{"1.4", "1.3"}},
+		{"1.0,1.9,x", []string{"1.0"}},
+		{"", []string{}},
+	}
+	for _, tt := range tests {
+		if got := ParseCwmpVersions(tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseCwmpVersions(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+const testEnvelopeHead = `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:cwmp="urn:dslforum-org:cwmp-1-0">`
+
+func TestSplitEnvelopes(t *testing.T) {
+	env1 := testEnvelopeHead + `<soap:Body><cwmp:Inform></cwmp:Inform></soap:Body></soap:Envelope>`
+	env2 := testEnvelopeHead + `<soap:Body><cwmp:TransferComplete/></soap:Body></soap:Envelope>`
+	tests := []struct {
+		name string
+		data string
+		want []string
+		fail bool
+	}{
+		{"one", env1, []string{env1}, false},
+		{"xml declaration", `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + env1, []string{env1}, false},
+		{"two", env1 + env2, []string{env1, env2}, false},
+		{"whitespace between", env1 + "\r\n  " + env2 + "\n", []string{env1, env2}, false},
+		{"empty", "", []string{}, false},
+		{"whitespace", " \n", []string{}, false},
+		{"truncated", env1 + env2[:40], nil, true},
+		{"mismatched", testEnvelopeHead + `<soap:Body></soap:Envelope>`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks, err := SplitEnvelopes([]byte(tt.data))
+			if (err != nil) != tt.fail {
+				t.Fatalf("error %v, want failure %v", err, tt.fail)
+			}
+			if tt.fail {
+				return
+			}
+			got := []string{}
+			for _, v := range chunks {
+				got = append(got, string(v))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("chunks %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetBodyElementName(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+		fail bool
+	}{
+		{"inform", `<soap:Header><cwmp:ID>1</cwmp:ID></soap:Header><soap:Body><cwmp:Inform><DeviceId/></cwmp:Inform></soap:Body>`, "Inform", false},
+		{"response", `<soap:Body><cwmp:GetParameterValuesResponse/></soap:Body>`, "GetParameterValuesResponse", false},
+		{"fault", `<soap:Body><soap:Fault><faultcode>Client</faultcode></soap:Fault></soap:Body>`, "Fault", false},
+		{"vendor method", `<soap:Body><cwmp:X_001122_Foo/></soap:Body>`, "X_001122_Foo", false},
+		{"header element named body", `<soap:Header><Body/></soap:Header><soap:Body><cwmp:Kicked/></soap:Body>`, "Kicked", false},
+		{"empty body", `<soap:Body></soap:Body>`, "", false},
+		{"no body", `<soap:Header></soap:Header>`, "", false},
+		{"malformed", `<soap:Header></soap:Body>`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetBodyElementName([]byte(testEnvelopeHead + tt.data + `</soap:Envelope>`))
+			if (err != nil) != tt.fail {
+				t.Fatalf("error %v, want failure %v", err, tt.fail)
+			}
+			if got != tt.want {
+				t.Fatalf("name %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package stun
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+
+	"github.com/pion/stun"
+	"github.com/pkg/errors"
+)
+
+// Attributes of TR-069 Annex G and RFC 3489.
+const (
+	AttrChangeRequest            stun.AttrType = 0x0003
+	AttrSourceAddress            stun.AttrType = 0x0004
+	AttrChangedAddress           stun.AttrType = 0x0005
+	AttrConnectionRequestBinding stun.AttrType = 0xC001
+	AttrBindingChange            stun.AttrType = 0xC002
+)
+
+// CHANGE-REQUEST flags of RFC 3489.
+const (
+	changeIPFlag   = 0x04
+	changePortFlag = 0x02
+)
+
+// addressAttr is an RFC 3489 address attribute, encoded like MAPPED-ADDRESS.
+type addressAttr struct {
+	typ  stun.AttrType
+	ip   net.IP
+	port int
+}
+
+func newAddressAttr(typ stun.AttrType, addr net.Addr) *addressAttr {
+	a := &addressAttr{typ: typ}
+	if v, ok := addr.(*net.UDPAddr); ok {
+		a.ip, a.port = v.IP, v.Port
+	}
+	return a
+}
+
+func (a *addressAttr) AddTo(m *stun.Message) error {
+	family, ip := uint16(0x01), a.ip.To4()
+	if ip == nil {
+		family, ip = 0x02, a.ip.To16()
+	}
+	if ip == nil {
+		return errors.Errorf("invalid address %v", a.ip)
+	}
+	v := make([]byte, 4+len(ip))
+	binary.BigEndian.PutUint16(v[0:2], family)
+	binary.BigEndian.PutUint16(v[2:4], uint16(a.port))
+	copy(v[4:], ip)
+	m.Add(a.typ, v)
+	return nil
+}
+
+// Binding is the public address a CPE's binding request came from.
+type Binding struct {
+	// Username is the STUNUsername of the CPE.
+	Username string
+	Addr     *net.UDPAddr
+	// ConnectionRequestBinding is true if the request carried
+	// CONNECTION-REQUEST-BINDING, the binding then serves UDP connection requests.
+	ConnectionRequestBinding bool
+	// BindingChange is true if the CPE noticed its binding has changed.
+	BindingChange bool
+}
+
+// Handler authenticates the binding requests of CPEs and receives their
+// bindings.
+type Handler interface {
+	// GetPassword returns the STUNPassword of username, ok is false for unknown CPEs.
+	GetPassword(username string) (password string, ok bool)
+	HandleBinding(binding *Binding)
+}
+
+// handleBinding authenticates a binding request carrying USERNAME with its
+// MESSAGE-INTEGRITY and reports the binding to the handler. raw is the
+// request as received, classic is true for RFC 3489 requests.
+func (s *stunServer) handleBinding(req *stun.Message, raw []byte, classic bool, addr *net.UDPAddr) error {
+	if s.opts.Handler == nil {
+		return nil
+	}
+	username, err := req.Get(stun.AttrUsername)
+	if err == stun.ErrAttributeNotFound {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "get username")
+	}
+	password, ok := s.opts.Handler.GetPassword(string(username))
+	if !ok {
+		return errors.Errorf("unknown username %v", string(username))
+	}
+	if err := checkMessageIntegrity(raw, password, classic); err != nil {
+		return errors.Wrapf(err, "check message integrity of %v", string(username))
+	}
+	s.opts.Handler.HandleBinding(&Binding{
+		Username:                 string(username),
+		Addr:                     addr,
+		ConnectionRequestBinding: req.Contains(AttrConnectionRequestBinding),
+		BindingChange:            req.Contains(AttrBindingChange),
+	})
+	return nil
+}
+
+// checkMessageIntegrity verifies the HMAC-SHA1 MESSAGE-INTEGRITY of raw with
+// password. RFC 5389 covers the message up to the attribute with the length
+// adjusted to end there, RFC 3489 pads the covered text to 64 bytes instead.
+func checkMessageIntegrity(raw []byte, password string, classic bool) error {
+	const headerSize = 20
+	offset := headerSize
+	for offset+4 <= len(raw) {
+		typ := stun.AttrType(binary.BigEndian.Uint16(raw[offset:]))
+		length := int(binary.BigEndian.Uint16(raw[offset+2:]))
+		if offset+4+length > len(raw) {
+			return errors.New("truncated attribute")
+		}
+		if typ != stun.AttrMessageIntegrity {
+			offset += 4 + (length+3)/4*4
+			continue
+		}
+		if length != sha1.Size {
+			return errors.New("invalid message integrity length")
+		}
+		text := make([]byte, offset)
+		copy(text, raw[:offset])
+		if classic {
+			if pad := len(text) % 64; pad != 0 {
+				text = append(text, make([]byte, 64-pad)...)
+			}
+		} else {
+			binary.BigEndian.PutUint16(text[2:4], uint16(offset+4+sha1.Size-headerSize))
+		}
+		h := hmac.New(sha1.New, []byte(password))
+		h.Write(text)
+		if !bytes.Equal(h.Sum(nil), raw[offset+4:offset+4+sha1.Size]) {
+			return errors.New("message integrity mismatch")
+		}
+		return nil
+	}
+	return errors.New("message integrity missing")
+}
@@ -0,0 +1,70 @@
+package stun
+
+import (
+	"strings"
+	"testing"
+)
+
+// rfc5769Request is the sample request of RFC 5769 2.1, its MESSAGE-INTEGRITY
+// is followed by a FINGERPRINT.
+const rfc5769Request = "\x00\x01\x00\x58" +
+	"\x21\x12\xa4\x42" +
+	"\xb7\xe7\xa7\x01\xbc\x34\xd6\x86\xfa\x87\xdf\xae" +
+	"\x80\x22\x00\x10" +
+	"STUN test client" +
+	"\x00\x24\x00\x04" +
+	"\x6e\x00\x01\xff" +
+	"\x80\x29\x00\x08" +
+	"\x93\x2f\xf9\xb1\x51\x26\x3b\x36" +
+	"\x00\x06\x00\x09" +
+	"\x65\x76\x74\x6a\x3a\x68\x36\x76\x59\x20\x20\x20" +
+	"\x00\x08\x00\x14" +
+	"\x9a\xea\xa7\x0c\xbf\xd8\xcb\x56\x78\x1e\xf2\xb5" +
+	"\xb2\xd3\xf2\x49\xc1\xb5\x71\xa2" +
+	"\x80\x28\x00\x04" +
+	"\xe5\x7a\x3b\xcf"
+
+const rfc5769Password = "VOkJxbRl1RmTxUk/WvJxBt"
+
+// classicRequest is an RFC 3489 Annex G binding request of USERNAME "cpe1"
+// with password "secret", the HMAC covers the first 52 bytes padded to 64.
+const classicRequest = "\x00\x01\x00\x38" +
+	"\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10" +
+	"\x00\x06\x00\x04" +
+	"cpe1" +
+	"\xc0\x01\x00\x14" +
+	"dslforum.org/TR-111 " +
+	"\x00\x08\x00\x14" +
+	"\x6d\xa6\xd2\x9c\xf0\x78\x84\x88\xb0\xa6\xe5\x5a\x11\x96\xe6\xfc" +
+	"\xdb\x3e\xba\xba"
+
+func TestCheckMessageIntegrity(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		password string
+		classic  bool
+		err      string
+	}{
+		{"rfc5389", rfc5769Request, rfc5769Password, false, ""},
+		{"classic", classicRequest, "secret", true, ""},
+		{"rfc5389 wrong password", rfc5769Request, "wrong", false, "mismatch"},
+		{"classic wrong password", classicRequest, "wrong", true, "mismatch"},
+		// each HMAC covers a different text
+		{"rfc5389 as classic", rfc5769Request, rfc5769Password, true, "mismatch"},
+		{"classic as rfc5389", classicRequest, "secret", false, "mismatch"},
+		{"truncated attribute", classicRequest[:len(classicRequest)-1], "secret", true, "truncated attribute"},
+		{"truncated before integrity", classicRequest[:40], "secret", true, "truncated attribute"},
+		{"missing integrity", classicRequest[:52], "secret", true, "missing"},
+		{"invalid integrity length", classicRequest[:54] + "\x00\x10" + classicRequest[56:72], "secret", true, "invalid message integrity length"},
+	}
+	for _, tt := range tests {
+		err := checkMessageIntegrity([]byte(tt.raw), tt.password, tt.classic)
+		if tt.err == "" && err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%v: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
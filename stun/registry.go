@@ -0,0 +1,150 @@
+package stun
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// RegistryEntry is the current connection request binding of a CPE.
+type RegistryEntry struct {
+	// Username is the STUNUsername identifying the CPE.
+	Username  string
+	Addr      *net.UDPAddr
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// BindingEvent reports a new or moved binding, OldAddr is nil for a new one.
+type BindingEvent struct {
+	Username string
+	OldAddr  *net.UDPAddr
+	NewAddr  *net.UDPAddr
+	// Changed is true if the CPE itself reported BINDING-CHANGE.
+	Changed bool
+}
+
+type RegistryOptions struct {
+	// TTL is how long a binding is kept after the last binding request, 5m if
+	// zero. It should exceed the STUNMaximumKeepAlivePeriod of the CPEs.
+	TTL time.Duration
+	// GetPassword returns the STUNPassword of a CPE, see Handler.
+	GetPassword func(username string) (password string, ok bool)
+	// OnChange is called when a binding is new or moved.
+	OnChange func(event *BindingEvent)
+}
+
+// Registry keeps the connection request bindings reported by the STUN
+// server. It is a Handler, pass it in Options.
+type Registry struct {
+	opts RegistryOptions
+
+	mutex    sync.Mutex
+	bindings map[string]*RegistryEntry
+	pruned   time.Time
+}
+
+func NewRegistry(opts RegistryOptions) *Registry {
+	if opts.TTL <= 0 {
+		opts.TTL = 5 * time.Minute
+	}
+	return &Registry{
+		opts:     opts,
+		bindings: map[string]*RegistryEntry{},
+		pruned:   time.Now(),
+	}
+}
+
+func (r *Registry) GetPassword(username string) (string, bool) {
+	if r.opts.GetPassword == nil {
+		return "", false
+	}
+	return r.opts.GetPassword(username)
+}
+
+// HandleBinding records bindings carrying CONNECTION-REQUEST-BINDING, other
+// binding requests don't come from the connection request port.
+func (r *Registry) HandleBinding(binding *Binding) {
+	if !binding.ConnectionRequestBinding {
+		return
+	}
+	now := time.Now()
+	var event *BindingEvent
+
+	r.mutex.Lock()
+	if now.Sub(r.pruned) > r.opts.TTL {
+		r.prune(now)
+	}
+	entry, ok := r.bindings[binding.Username]
+	if !ok || now.Sub(entry.LastSeen) > r.opts.TTL {
+		entry = &RegistryEntry{Username: binding.Username, FirstSeen: now}
+		r.bindings[binding.Username] = entry
+	}
+	if entry.Addr == nil || !entry.Addr.IP.Equal(binding.Addr.IP) || entry.Addr.Port != binding.Addr.Port {
+		event = &BindingEvent{
+			Username: binding.Username,
+			OldAddr:  entry.Addr,
+			NewAddr:  binding.Addr,
+			Changed:  binding.BindingChange,
+		}
+		entry.Addr = binding.Addr
+		entry.FirstSeen = now
+	}
+	entry.LastSeen = now
+	r.mutex.Unlock()
+
+	if event != nil && r.opts.OnChange != nil {
+		r.opts.OnChange(event)
+	}
+}
+
+// Lookup returns a copy of the unexpired binding of username.
+func (r *Registry) Lookup(username string) (*RegistryEntry, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry, ok := r.bindings[username]
+	if !ok || time.Since(entry.LastSeen) > r.opts.TTL {
+		return nil, false
+	}
+	v := *entry
+	return &v, true
+}
+
+// GetUDPConnectionRequestAddress returns the "host:port" address to send
+// UDP connection requests of username to.
+func (r *Registry) GetUDPConnectionRequestAddress(username string) (string, bool) {
+	entry, ok := r.Lookup(username)
+	if !ok {
+		return "", false
+	}
+	return entry.Addr.String(), true
+}
+
+// Entries returns copies of the unexpired bindings.
+func (r *Registry) Entries() []*RegistryEntry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.prune(time.Now())
+	out := []*RegistryEntry{}
+	for _, entry := range r.bindings {
+		v := *entry
+		out = append(out, &v)
+	}
+	return out
+}
+
+// Remove forgets the binding of username.
+func (r *Registry) Remove(username string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.bindings, username)
+}
+
+func (r *Registry) prune(now time.Time) {
+	for k, v := range r.bindings {
+		if now.Sub(v.LastSeen) > r.opts.TTL {
+			delete(r.bindings, k)
+		}
+	}
+	r.pruned = now
+}
@@ -0,0 +1,127 @@
+package stun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestRegistry(opts RegistryOptions) (*Registry, *[]*BindingEvent) {
+	events := &[]*BindingEvent{}
+	opts.OnChange = func(event *BindingEvent) {
+		*events = append(*events, event)
+	}
+	return NewRegistry(opts), events
+}
+
+func newTestBinding(username string, addr string) *Binding {
+	v, _ := net.ResolveUDPAddr("udp", addr)
+	return &Binding{Username: username, Addr: v, ConnectionRequestBinding: true}
+}
+
+// ageTestRegistry makes all bindings of r d older.
+func ageTestRegistry(r *Registry, d time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, entry := range r.bindings {
+		entry.FirstSeen = entry.FirstSeen.Add(-d)
+		entry.LastSeen = entry.LastSeen.Add(-d)
+	}
+	r.pruned = r.pruned.Add(-d)
+}
+
+func TestRegistryIgnoresOtherBindings(t *testing.T) {
+	r, events := newTestRegistry(RegistryOptions{})
+	b := newTestBinding("cpe1", "192.0.2.1:7547")
+	b.ConnectionRequestBinding = false
+	r.HandleBinding(b)
+
+	if _, ok := r.Lookup("cpe1"); ok {
+		t.Fatal("binding without CONNECTION-REQUEST-BINDING recorded")
+	}
+	if len(*events) != 0 {
+		t.Fatalf("events %v", *events)
+	}
+}
+
+func TestRegistryOnChange(t *testing.T) {
+	r, events := newTestRegistry(RegistryOptions{})
+
+	r.HandleBinding(newTestBinding("cpe1", "192.0.2.1:7547"))
+	if len(*events) != 1 || (*events)[0].OldAddr != nil || (*events)[0].NewAddr.String() != "192.0.2.1:7547" {
+		t.Fatalf("new binding events %+v", *events)
+	}
+	if v, ok := r.GetUDPConnectionRequestAddress("cpe1"); !ok || v != "192.0.2.1:7547" {
+		t.Fatalf("address %q %v", v, ok)
+	}
+
+	// a keep-alive from the same address is not a change
+	ageTestRegistry(r, time.Minute)
+	r.HandleBinding(newTestBinding("cpe1", "192.0.2.1:7547"))
+	if len(*events) != 1 {
+		t.Fatalf("keep-alive events %+v", *events)
+	}
+	entry, _ := r.Lookup("cpe1")
+	if time.Since(entry.LastSeen) > time.Second || time.Since(entry.FirstSeen) < time.Minute {
+		t.Fatalf("keep-alive first seen %v last seen %v", entry.FirstSeen, entry.LastSeen)
+	}
+
+	// a new port is a move, reported with the old address
+	b := newTestBinding("cpe1", "192.0.2.1:7548")
+	b.BindingChange = true
+	r.HandleBinding(b)
+	if len(*events) != 2 {
+		t.Fatalf("move events %+v", *events)
+	}
+	if v := (*events)[1]; v.Username != "cpe1" || v.OldAddr.String() != "192.0.2.1:7547" || v.NewAddr.String() != "192.0.2.1:7548" || !v.Changed {
+		t.Fatalf("move event %+v", v)
+	}
+	entry, _ = r.Lookup("cpe1")
+	if entry.Addr.String() != "192.0.2.1:7548" || time.Since(entry.FirstSeen) > time.Second {
+		t.Fatalf("moved entry %+v", entry)
+	}
+
+	// so is a new IP, without BINDING-CHANGE
+	r.HandleBinding(newTestBinding("cpe1", "198.51.100.1:7548"))
+	if len(*events) != 3 || (*events)[2].Changed || (*events)[2].OldAddr.String() != "192.0.2.1:7548" {
+		t.Fatalf("move events %+v", *events)
+	}
+}
+
+func TestRegistryExpiry(t *testing.T) {
+	r, events := newTestRegistry(RegistryOptions{TTL: time.Minute})
+	r.HandleBinding(newTestBinding("cpe1", "192.0.2.1:7547"))
+	r.HandleBinding(newTestBinding("cpe2", "192.0.2.2:7547"))
+	if v := r.Entries(); len(v) != 2 {
+		t.Fatalf("entries %v", len(v))
+	}
+
+	ageTestRegistry(r, 2*time.Minute)
+	if _, ok := r.Lookup("cpe1"); ok {
+		t.Fatal("expired binding found")
+	}
+	if _, ok := r.GetUDPConnectionRequestAddress("cpe1"); ok {
+		t.Fatal("expired address found")
+	}
+
+	// an expired binding is new again, even from the same address
+	r.HandleBinding(newTestBinding("cpe1", "192.0.2.1:7547"))
+	if len(*events) != 3 || (*events)[2].OldAddr != nil {
+		t.Fatalf("events %+v", *events)
+	}
+	// and the other expired bindings are pruned
+	r.mutex.Lock()
+	n := len(r.bindings)
+	r.mutex.Unlock()
+	if n != 1 {
+		t.Fatalf("%v bindings kept", n)
+	}
+	if v := r.Entries(); len(v) != 1 || v[0].Username != "cpe1" {
+		t.Fatalf("entries %+v", v)
+	}
+
+	r.Remove("cpe1")
+	if _, ok := r.Lookup("cpe1"); ok {
+		t.Fatal("removed binding found")
+	}
+}
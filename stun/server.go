@@ -4,13 +4,17 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"strconv"
 	"sync"
 
+	"github.com/pion/stun"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
-	"gortc.io/stun"
 )
 
+// magicCookie is the fixed value of RFC 5389 in bytes 4 to 8 of a message.
+const magicCookie = 0x2112A442
+
 var errNotSTUNMessage = errors.New("not stun message")
 var software = stun.NewSoftware("stund")
 
@@ -19,16 +23,35 @@ type STUNServer interface {
 	Close()
 }
 
+// Options configures a STUN server.
+type Options struct {
+	// Handler authenticates TR-069 Annex G binding requests and receives the
+	// bindings, requests are answered without authentication if nil.
+	Handler Handler
+	// AlternateAddr is the "ip:port" of a second IP and port for RFC 3489
+	// CHANGE-REQUEST, both have to differ from the listening address.
+	// CHANGE-REQUEST is refused if empty.
+	AlternateAddr string
+}
+
 type stunServer struct {
-	logger       *zap.Logger
-	conn         net.PacketConn
+	opts   Options
+	logger *zap.Logger
+	// conns are indexed by IP and port, conns[0][0] is the listening address
+	// and the others are only set with an alternate address.
+	conns        [2][2]net.PacketConn
 	shutdown     bool
 	shutdownCh   chan struct{}
 	shutdownLock sync.Mutex
 }
 
 func NewSTUNServer(network string, addr string) STUNServer {
+	return NewSTUNServerWithOptions(network, addr, Options{})
+}
+
+func NewSTUNServerWithOptions(network string, addr string, opts Options) STUNServer {
 	s := &stunServer{
+		opts:       opts,
 		shutdownCh: make(chan struct{}),
 	}
 	s.logger = zap.L().Named("stun")
@@ -37,10 +60,61 @@ func NewSTUNServer(network string, addr string) STUNServer {
 		s.logger.Error("listen packet", zap.Error(err))
 		return nil
 	}
-	s.conn = conn
+	s.conns[0][0] = conn
+	if opts.AlternateAddr != "" {
+		if err := s.listenAlternate(network, opts.AlternateAddr); err != nil {
+			s.logger.Error("listen alternate", zap.Error(err))
+			s.closeConns()
+			return nil
+		}
+	}
 	return s
 }
 
+// listenAlternate listens on the combinations of the primary and the
+// alternate IP and port.
+func (s *stunServer) listenAlternate(network string, addr string) error {
+	primary, ok := s.conns[0][0].LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return errors.Errorf("unknown addr: %v", s.conns[0][0].LocalAddr())
+	}
+	alternate, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return errors.Wrap(err, "resolve alternate address")
+	}
+	if primary.IP.IsUnspecified() || alternate.IP.IsUnspecified() || primary.IP.Equal(alternate.IP) {
+		return errors.New("primary and alternate address need distinct IPs")
+	}
+	if primary.Port == alternate.Port {
+		return errors.New("primary and alternate address need distinct ports")
+	}
+	ips := [2]net.IP{primary.IP, alternate.IP}
+	ports := [2]int{primary.Port, alternate.Port}
+	for i := range ips {
+		for j := range ports {
+			if i == 0 && j == 0 {
+				continue
+			}
+			conn, err := net.ListenPacket(network, net.JoinHostPort(ips[i].String(), strconv.Itoa(ports[j])))
+			if err != nil {
+				return errors.Wrap(err, "listen packet")
+			}
+			s.conns[i][j] = conn
+		}
+	}
+	return nil
+}
+
+func (s *stunServer) closeConns() {
+	for _, row := range s.conns {
+		for _, conn := range row {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+}
+
 func (s *stunServer) Close() {
 	s.shutdownLock.Lock()
 	defer s.shutdownLock.Unlock()
@@ -60,61 +134,73 @@ func (s *stunServer) Run() {
 	var wg sync.WaitGroup
 	defer wg.Wait()
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		var (
-			res = new(stun.Message)
-			req = new(stun.Message)
-		)
-		for {
-			if s.shutdown {
-				return
-			}
-			if err := s.serveConn(res, req); err != nil {
-				s.logger.Error("serve conn", zap.Error(err))
+	for _, row := range s.conns {
+		for _, conn := range row {
+			if conn == nil {
 				continue
 			}
-			res.Reset()
-			req.Reset()
+			wg.Add(1)
+			go func(conn net.PacketConn) {
+				defer wg.Done()
+				var (
+					res = new(stun.Message)
+					req = new(stun.Message)
+				)
+				for {
+					select {
+					case <-s.shutdownCh:
+						return
+					default:
+					}
+					if err := s.serveConn(conn, res, req); err != nil {
+						s.logger.Error("serve conn", zap.Error(err))
+						continue
+					}
+					res.Reset()
+					req.Reset()
+				}
+			}(conn)
 		}
-	}()
+	}
 
 	<-s.shutdownCh
 
-	if s.conn != nil {
-		s.conn.Close()
-	}
+	s.closeConns()
 }
 
-func (s *stunServer) serveConn(res, req *stun.Message) error {
-	if s.conn == nil {
+func (s *stunServer) serveConn(conn net.PacketConn, res, req *stun.Message) error {
+	if conn == nil {
 		return nil
 	}
 	buf := make([]byte, 1024)
-	n, addr, err := s.conn.ReadFrom(buf)
+	n, addr, err := conn.ReadFrom(buf)
 	if err != nil {
 		return errors.Wrap(err, "ReadFrom")
 	}
-	needChange := false
-	if binary.BigEndian.Uint32(buf[4:8]) == 0x30313031 {
-		needChange = true
-		binary.BigEndian.PutUint32(buf[4:8], 0x2112A442)
+	raw := append([]byte(nil), buf[:n]...)
+	// RFC 3489 has no magic cookie, the first 4 bytes of its 128 bit
+	// transaction ID take its place. They are swapped for the cookie to parse
+	// the request and restored in the response.
+	cookie := binary.BigEndian.Uint32(buf[4:8])
+	needChange := n >= 20 && cookie != magicCookie
+	if needChange {
+		binary.BigEndian.PutUint32(buf[4:8], magicCookie)
 	}
 
 	if _, err := req.Write(buf[:n]); err != nil {
 		return errors.Wrap(err, "Write")
 	}
-	if err := s.basicProcess(addr, buf[:n], req, res); err != nil {
+	out, err := s.basicProcess(conn, addr, buf[:n], raw, needChange, req, res)
+	if err != nil {
 		if err == errNotSTUNMessage {
 			return nil
 		}
 		return errors.Wrap(err, "basicProcess")
 	}
 	if needChange {
-		binary.BigEndian.PutUint32(res.Raw[4:8], 0x30313031)
+		binary.BigEndian.PutUint32(res.Raw[4:8], cookie)
 	}
-	if _, err := s.conn.WriteTo(res.Raw, addr); err != nil {
+	if _, err := out.WriteTo(res.Raw, addr); err != nil {
 		return errors.Wrap(err, "WriteTo")
 	}
 	s.logger.Warn("debug", zap.Any("req", req), zap.Any("resp", res))
@@ -122,12 +208,15 @@ func (s *stunServer) serveConn(res, req *stun.Message) error {
 	return nil
 }
 
-func (s *stunServer) basicProcess(addr net.Addr, b []byte, req, res *stun.Message) error {
+// basicProcess answers a binding request received on conn and returns the
+// connection to send the response from. raw is the request as received and
+// classic is true for RFC 3489 requests.
+func (s *stunServer) basicProcess(conn net.PacketConn, addr net.Addr, b []byte, raw []byte, classic bool, req, res *stun.Message) (net.PacketConn, error) {
 	if !stun.IsMessage(b) {
-		return errNotSTUNMessage
+		return nil, errNotSTUNMessage
 	}
 	if _, err := req.Write(b); err != nil {
-		return errors.Wrap(err, "failed to read message")
+		return nil, errors.Wrap(err, "failed to read message")
 	}
 	var (
 		ip   net.IP
@@ -138,16 +227,96 @@ func (s *stunServer) basicProcess(addr net.Addr, b []byte, req, res *stun.Messag
 		ip = a.IP
 		port = a.Port
 	default:
-		return errors.New(fmt.Sprintf("unknown addr: %v", addr))
+		return nil, errors.New(fmt.Sprintf("unknown addr: %v", addr))
 	}
 	s.logger.Debug("debug", zap.String("ip", ip.String()), zap.Int("port", port))
-	return res.Build(req,
+	if err := s.handleBinding(req, raw, classic, &net.UDPAddr{IP: ip, Port: port}); err != nil {
+		s.logger.Warn("binding request rejected", zap.Error(err))
+		return conn, buildErrorResponse(req, res, classic, stun.CodeUnauthorized, "Unauthorized")
+	}
+	out, err := s.getResponseConn(conn, req)
+	if err != nil {
+		s.logger.Warn("change request rejected", zap.Error(err))
+		return conn, buildErrorResponse(req, res, classic, stun.CodeUnknownAttribute, "Unknown Attribute")
+	}
+
+	setters := []stun.Setter{
+		req,
 		stun.BindingSuccess,
 		software,
-		&stun.XORMappedAddress{
+		&stun.MappedAddress{
 			IP:   ip,
 			Port: port,
 		},
-		stun.Fingerprint,
-	)
+	}
+	if !classic {
+		setters = append(setters, &stun.XORMappedAddress{
+			IP:   ip,
+			Port: port,
+		})
+	}
+	if s.conns[1][1] != nil {
+		setters = append(setters,
+			newAddressAttr(AttrSourceAddress, out.LocalAddr()),
+			newAddressAttr(AttrChangedAddress, s.conns[1][1].LocalAddr()),
+		)
+	}
+	if !classic {
+		setters = append(setters, stun.Fingerprint)
+	}
+	return out, res.Build(setters...)
+}
+
+// getResponseConn returns the connection that honours the CHANGE-REQUEST of
+// req received on conn.
+func (s *stunServer) getResponseConn(conn net.PacketConn, req *stun.Message) (net.PacketConn, error) {
+	v, err := req.Get(AttrChangeRequest)
+	if err == stun.ErrAttributeNotFound {
+		return conn, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "get change request")
+	}
+	if len(v) != 4 {
+		return nil, errors.Errorf("invalid change request length %v", len(v))
+	}
+	flags := binary.BigEndian.Uint32(v)
+	changeIP, changePort := flags&changeIPFlag != 0, flags&changePortFlag != 0
+	if !changeIP && !changePort {
+		return conn, nil
+	}
+	if s.conns[1][1] == nil {
+		return nil, errors.New("alternate address not configured")
+	}
+	for i, row := range s.conns {
+		for j, v := range row {
+			if v != conn {
+				continue
+			}
+			if changeIP {
+				i ^= 1
+			}
+			if changePort {
+				j ^= 1
+			}
+			return s.conns[i][j], nil
+		}
+	}
+	return nil, errors.New("unknown connection")
+}
+
+func buildErrorResponse(req, res *stun.Message, classic bool, code stun.ErrorCode, reason string) error {
+	setters := []stun.Setter{
+		req,
+		stun.NewType(stun.MethodBinding, stun.ClassErrorResponse),
+		software,
+		&stun.ErrorCodeAttribute{
+			Code:   code,
+			Reason: []byte(reason),
+		},
+	}
+	if !classic {
+		setters = append(setters, stun.Fingerprint)
+	}
+	return res.Build(setters...)
 }
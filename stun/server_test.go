@@ -0,0 +1,110 @@
+package stun
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T) *stunServer {
+	s, ok := NewSTUNServerWithOptions("udp4", "127.0.0.1:0", Options{}).(*stunServer)
+	if !ok {
+		t.Fatal("listen failed")
+	}
+	go s.Run()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// sendTestRequest sends a binding request with the transaction ID of bytes 4
+// to 20 of id and returns the response.
+func sendTestRequest(t *testing.T, s *stunServer, id []byte) (*net.UDPConn, []byte) {
+	conn, err := net.DialUDP("udp4", nil, s.conns[0][0].LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	req := make([]byte, 20)
+	binary.BigEndian.PutUint16(req[0:2], 0x0001)
+	copy(req[4:20], id)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < 20 {
+		t.Fatalf("short response %x", buf[:n])
+	}
+	return conn, buf[:n]
+}
+
+// getTestAttrs returns the attributes of the message b by type.
+func getTestAttrs(b []byte) map[uint16][]byte {
+	attrs := map[uint16][]byte{}
+	for b = b[20:]; len(b) >= 4; {
+		typ, length := binary.BigEndian.Uint16(b[0:2]), int(binary.BigEndian.Uint16(b[2:4]))
+		if len(b) < 4+length {
+			break
+		}
+		attrs[typ] = b[4 : 4+length]
+		b = b[4+(length+3)&^3:]
+	}
+	return attrs
+}
+
+func TestServeClassicRequest(t *testing.T) {
+	s := newTestServer(t)
+	id := make([]byte, 16)
+	for {
+		rand.Read(id)
+		if binary.BigEndian.Uint32(id) != magicCookie {
+			break
+		}
+	}
+	conn, res := sendTestRequest(t, s, id)
+
+	if v := binary.BigEndian.Uint16(res[0:2]); v != 0x0101 {
+		t.Fatalf("type %#04x, want binding success", v)
+	}
+	if !bytes.Equal(res[4:20], id) {
+		t.Fatalf("transaction %x, want %x", res[4:20], id)
+	}
+	attrs := getTestAttrs(res)
+	mapped, ok := attrs[0x0001]
+	if !ok || len(mapped) != 8 {
+		t.Fatalf("mapped address %x", mapped)
+	}
+	if port := int(binary.BigEndian.Uint16(mapped[2:4])); port != conn.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatalf("mapped port %v, want %v", port, conn.LocalAddr().(*net.UDPAddr).Port)
+	}
+	for _, typ := range []uint16{0x0020, 0x8028} {
+		if _, ok := attrs[typ]; ok {
+			t.Fatalf("RFC 5389 attribute %#04x in classic response", typ)
+		}
+	}
+}
+
+func TestServeRequest(t *testing.T) {
+	s := newTestServer(t)
+	id := make([]byte, 16)
+	binary.BigEndian.PutUint32(id, magicCookie)
+	rand.Read(id[4:])
+	_, res := sendTestRequest(t, s, id)
+
+	if !bytes.Equal(res[4:20], id) {
+		t.Fatalf("transaction %x, want %x", res[4:20], id)
+	}
+	attrs := getTestAttrs(res)
+	for _, typ := range []uint16{0x0001, 0x0020, 0x8028} {
+		if _, ok := attrs[typ]; !ok {
+			t.Fatalf("attribute %#04x missing", typ)
+		}
+	}
+}